@@ -3,6 +3,8 @@ package adapter
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/agonzalezro/botella/plugin"
 	"github.com/agonzalezro/botella/utils"
@@ -16,8 +18,33 @@ type Message struct {
 	Receiver string
 	Body     string
 
+	// ID identifies the message on the adapter, if it supports it
+	ID string
+	// Thread is the thread inside the receiver where the message is posted,
+	// on Slack it's the ID (ts) of the first message of the thread.
+	Thread string
+	// Format is the format of the body: plugin.FormatText, plugin.FormatMarkdown
+	// or plugin.FormatCode
+	Format string
+	// Reaction, when set, means that this is not a message but a reaction
+	// (an emoji name) to the message with the given ID.
+	Reaction string
+	// ReplyTo is the ID of the message that this one replies to, it's set on
+	// the replies sent to the same receiver of the message.
+	ReplyTo string
+	// Image is the image of the plugin that sent the reply (its name if it
+	// doesn't have an image), it's empty for the messages received and for
+	// the replies of botella itself.
+	Image string
+
 	IsChannel       bool
 	IsDirectMessage bool
+	// Mentioned is set when the bot was mentioned on the message, by the
+	// adapters that know it when they receive it.
+	Mentioned bool
+	// FromBot is set when the message was written by a bot, the plugins
+	// only receive them if they opt in.
+	FromBot bool
 }
 
 type Adapter interface {
@@ -25,6 +52,67 @@ type Adapter interface {
 	ShouldRun(*plugin.Plugin, *Message) bool
 }
 
+// Stopper is implemented by the adapters that need to release something
+// (a server, a connection...) on teardown.
+type Stopper interface {
+	Stop() error
+}
+
+// Result is the result of running a plugin for a message.
+type Result struct {
+	Plugin   string
+	Image    string
+	Stdout   string
+	Stderr   string
+	Err      error
+	Duration time.Duration
+	// Replies are the messages sent to the adapter for this run
+	Replies []Message
+}
+
+// Reporter is implemented by the adapters that need to know the result of
+// every plugin run for a message, and when all of them are done. The replies
+// are sent to the stdout channel as well.
+type Reporter interface {
+	Report(Message, Result)
+	Done(Message)
+}
+
+// optional returns the value of an optional key of the environment, empty if
+// it's not set.
+func optional(adapterName string, environment map[string]string, k string) string {
+	v, _ := utils.GetFromEnvOrFromMap(adapterName, environment, k)
+	return v
+}
+
+// optionalDuration returns the value of an optional duration of the
+// environment, 0 if it's not set.
+func optionalDuration(adapterName string, environment map[string]string, k string) (time.Duration, error) {
+	v := optional(adapterName, environment, k)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s in %s adapter should be a duration (30s, 1m...), it's: %s", k, adapterName, v)
+	}
+	return d, nil
+}
+
+// optionalBool returns the value of an optional boolean of the environment,
+// def if it's not set.
+func optionalBool(adapterName string, environment map[string]string, k string, def bool) (bool, error) {
+	v := optional(adapterName, environment, k)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s in %s adapter should be true or false, it's: %s", k, adapterName, v)
+	}
+	return b, nil
+}
+
 func New(adapterName string, environment map[string]string) (Adapter, error) {
 	switch adapterName {
 	case "slack":
@@ -33,6 +121,17 @@ func New(adapterName string, environment map[string]string) (Adapter, error) {
 			return nil, err
 		}
 		return NewSlack(key)
+	case "slack-socket":
+		appToken, err := utils.GetFromEnvOrFromMap(adapterName, environment, "app_token")
+		if err != nil {
+			return nil, err
+		}
+		botToken, err := utils.GetFromEnvOrFromMap(adapterName, environment, "bot_token")
+		if err != nil {
+			return nil, err
+		}
+		// The URL of the API is optional, it's mostly useful for testing
+		return NewSlackSocket(appToken, botToken, optional(adapterName, environment, "api_url"))
 	case "http":
 		port, err := utils.GetFromEnvOrFromMap(adapterName, environment, "port")
 		if err != nil {
@@ -42,7 +141,159 @@ func New(adapterName string, environment map[string]string) (Adapter, error) {
 		if err != nil {
 			return nil, fmt.Errorf("port in HTTP adapter should be an integer, it's: %s", port)
 		}
-		return NewHTTP(iport)
+		readTimeout, err := optionalDuration(adapterName, environment, "read_timeout")
+		if err != nil {
+			return nil, err
+		}
+		writeTimeout, err := optionalDuration(adapterName, environment, "write_timeout")
+		if err != nil {
+			return nil, err
+		}
+		tokens, err := parsePrincipals(optional(adapterName, environment, "tokens"))
+		if err != nil {
+			return nil, fmt.Errorf("tokens in HTTP adapter: %v", err)
+		}
+		secrets, err := parsePrincipals(optional(adapterName, environment, "hmac_secrets"))
+		if err != nil {
+			return nil, fmt.Errorf("hmac_secrets in HTTP adapter: %v", err)
+		}
+		window, err := optionalDuration(adapterName, environment, "hmac_window")
+		if err != nil {
+			return nil, err
+		}
+		jobsTTL, err := optionalDuration(adapterName, environment, "jobs_ttl")
+		if err != nil {
+			return nil, err
+		}
+		return NewHTTP(HTTPOptions{
+			Port:            iport,
+			Bind:            optional(adapterName, environment, "bind"),
+			PathPrefix:      optional(adapterName, environment, "path_prefix"),
+			CertFile:        optional(adapterName, environment, "cert_file"),
+			KeyFile:         optional(adapterName, environment, "key_file"),
+			ReadTimeout:     readTimeout,
+			WriteTimeout:    writeTimeout,
+			Tokens:          tokens,
+			HMACSecrets:     secrets,
+			SignatureWindow: window,
+			JobsTTL:         jobsTTL,
+		})
+	case "irc":
+		server, err := utils.GetFromEnvOrFromMap(adapterName, environment, "server")
+		if err != nil {
+			return nil, err
+		}
+		nick, err := utils.GetFromEnvOrFromMap(adapterName, environment, "nick")
+		if err != nil {
+			return nil, err
+		}
+		useTLS, err := optionalBool(adapterName, environment, "tls", false)
+		if err != nil {
+			return nil, err
+		}
+		var channels []string
+		for _, channel := range strings.Split(optional(adapterName, environment, "channels"), ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels = append(channels, channel)
+			}
+		}
+		return NewIRC(IRCOptions{
+			Server:       server,
+			TLS:          useTLS,
+			Password:     optional(adapterName, environment, "password"),
+			Nick:         nick,
+			User:         optional(adapterName, environment, "user"),
+			RealName:     optional(adapterName, environment, "real_name"),
+			SASLUser:     optional(adapterName, environment, "sasl_user"),
+			SASLPassword: optional(adapterName, environment, "sasl_password"),
+			Channels:     channels,
+		})
+	case "matrix":
+		homeserver, err := utils.GetFromEnvOrFromMap(adapterName, environment, "homeserver")
+		if err != nil {
+			return nil, err
+		}
+		accessToken, err := utils.GetFromEnvOrFromMap(adapterName, environment, "access_token")
+		if err != nil {
+			return nil, err
+		}
+		autoJoin, err := optionalBool(adapterName, environment, "auto_join", false)
+		if err != nil {
+			return nil, err
+		}
+		return NewMatrix(MatrixOptions{
+			Homeserver:  homeserver,
+			AccessToken: accessToken,
+			AutoJoin:    autoJoin,
+			SinceFile:   optional(adapterName, environment, "since_file"),
+		})
+	case "telegram":
+		token, err := utils.GetFromEnvOrFromMap(adapterName, environment, "token")
+		if err != nil {
+			return nil, err
+		}
+		options := TelegramOptions{
+			Token:       token,
+			APIURL:      optional(adapterName, environment, "api_url"),
+			WebhookURL:  optional(adapterName, environment, "webhook_url"),
+			Bind:        optional(adapterName, environment, "bind"),
+			SecretToken: optional(adapterName, environment, "secret_token"),
+		}
+		if options.WebhookURL != "" {
+			// The port is only needed to receive the updates on a webhook
+			port, err := utils.GetFromEnvOrFromMap(adapterName, environment, "port")
+			if err != nil {
+				return nil, err
+			}
+			if options.Port, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("port in Telegram adapter should be an integer, it's: %s", port)
+			}
+		}
+		return NewTelegram(options)
+	case "discord":
+		token, err := utils.GetFromEnvOrFromMap(adapterName, environment, "token")
+		if err != nil {
+			return nil, err
+		}
+		return NewDiscord(DiscordOptions{
+			Token:      token,
+			GatewayURL: optional(adapterName, environment, "gateway_url"),
+			APIURL:     optional(adapterName, environment, "api_url"),
+		})
+	case "mattermost":
+		url, err := utils.GetFromEnvOrFromMap(adapterName, environment, "url")
+		if err != nil {
+			return nil, err
+		}
+		token, err := utils.GetFromEnvOrFromMap(adapterName, environment, "token")
+		if err != nil {
+			return nil, err
+		}
+		return NewMattermost(MattermostOptions{URL: url, Token: token})
+	case "terminal":
+		options := TerminalOptions{
+			Name:     optional(adapterName, environment, "name"),
+			Emitter:  optional(adapterName, environment, "emitter"),
+			Receiver: optional(adapterName, environment, "receiver"),
+		}
+		if options.Emitter == "" {
+			options.Emitter = "me"
+		}
+		if options.Receiver == "" {
+			options.Receiver = "general"
+		}
+		var err error
+		if options.IsDirectMessage, err = optionalBool(adapterName, environment, "direct_message", false); err != nil {
+			return nil, err
+		}
+		// The messages are sent to a channel unless they are direct
+		if options.IsChannel, err = optionalBool(adapterName, environment, "channel", !options.IsDirectMessage); err != nil {
+			return nil, err
+		}
+		if options.Mention, err = optionalBool(adapterName, environment, "mention", false); err != nil {
+			return nil, err
+		}
+		return NewTerminal(options), nil
 	default:
 		return nil, fmt.Errorf("Adapter '%s' not found\n", adapterName)
 	}
@@ -0,0 +1,463 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+const (
+	discordGatewayURL = "wss://gateway.discord.gg/?v=10&encoding=json"
+	discordAPIURL     = "https://discord.com/api/v10"
+
+	// discordIntents are the events received: the guilds, their messages,
+	// the direct messages and the content of all of them.
+	discordIntents = 1<<0 | 1<<9 | 1<<12 | 1<<15
+)
+
+// The opcodes of the gateway
+const (
+	discordDispatch       = 0
+	discordHeartbeat      = 1
+	discordIdentify       = 2
+	discordResume         = 6
+	discordReconnect      = 7
+	discordInvalidSession = 9
+	discordHello          = 10
+	discordHeartbeatACK   = 11
+)
+
+var errDiscordZombie = errors.New("the Discord gateway didn't acknowledge the last heartbeat")
+
+// DiscordOptions are the token of the bot and where the gateway and the REST
+// API are.
+type DiscordOptions struct {
+	Token string
+	// GatewayURL is wss://gateway.discord.gg/?v=10&encoding=json by default
+	GatewayURL string
+	// APIURL is https://discord.com/api/v10 by default
+	APIURL string
+}
+
+type DiscordAdapter struct {
+	options DiscordOptions
+	client  *http.Client
+	botID   string
+
+	mu sync.Mutex
+	// sessionID, resumeURL and seq are needed to resume the session after
+	// a disconnection without losing the events.
+	sessionID string
+	resumeURL string
+	seq       *int64
+	acked     bool
+
+	rateMu sync.Mutex
+	// blocked is until when a route (or all of them, with the empty key) is
+	// rate limited.
+	blocked map[string]time.Time
+
+	minBackoff, maxBackoff time.Duration
+}
+
+type discordPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+type discordUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Bot      bool   `json:"bot"`
+}
+
+type discordMessage struct {
+	ID        string        `json:"id"`
+	ChannelID string        `json:"channel_id"`
+	GuildID   string        `json:"guild_id"`
+	Author    discordUser   `json:"author"`
+	Content   string        `json:"content"`
+	Mentions  []discordUser `json:"mentions"`
+}
+
+// discordError is an error returned by the REST API.
+type discordError struct {
+	Status  int
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *discordError) Error() string {
+	return fmt.Sprintf("Discord error (%d): %s", e.Status, e.Message)
+}
+
+func NewDiscord(options DiscordOptions) (*DiscordAdapter, error) {
+	if options.GatewayURL == "" {
+		options.GatewayURL = discordGatewayURL
+	}
+	if options.APIURL == "" {
+		options.APIURL = discordAPIURL
+	}
+	options.APIURL = strings.TrimSuffix(options.APIURL, "/")
+
+	da := &DiscordAdapter{
+		options:    options,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		blocked:    make(map[string]time.Time),
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+
+	var me discordUser
+	if err := da.call("GET", "/users/@me", nil, &me); err != nil {
+		return nil, err
+	}
+	da.botID = me.ID
+	return da, nil
+}
+
+// wait waits until the route isn't rate limited anymore.
+func (da *DiscordAdapter) wait(route string) {
+	da.rateMu.Lock()
+	until := da.blocked[route]
+	if global := da.blocked[""]; global.After(until) {
+		until = global
+	}
+	da.rateMu.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+func (da *DiscordAdapter) block(route string, d time.Duration) {
+	da.rateMu.Lock()
+	defer da.rateMu.Unlock()
+	da.blocked[route] = time.Now().Add(d)
+}
+
+// secondsHeader returns the value of a header with seconds, as the ones of
+// the rate limits.
+func secondsHeader(h http.Header, k string) time.Duration {
+	seconds, _ := strconv.ParseFloat(h.Get(k), 64)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// call calls the REST API respecting its rate limits, the response is decoded
+// on out unless it's nil.
+func (da *DiscordAdapter) call(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	route := method + " " + path
+
+	for {
+		da.wait(route)
+
+		req, err := http.NewRequest(method, da.options.APIURL+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bot "+da.options.Token)
+		req.Header.Set("User-Agent", "DiscordBot (https://github.com/agonzalezro/botella, 1.0)")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := da.client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			da.block(route, secondsHeader(resp.Header, "X-RateLimit-Reset-After"))
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			var limited struct {
+				RetryAfter float64 `json:"retry_after"`
+				Global     bool    `json:"global"`
+			}
+			json.Unmarshal(data, &limited)
+			blocked := route
+			if limited.Global {
+				blocked = ""
+			}
+			da.block(blocked, time.Duration(limited.RetryAfter*float64(time.Second)))
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			e := &discordError{Status: resp.StatusCode}
+			json.Unmarshal(data, e)
+			return e
+		}
+
+		if out == nil || len(data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	}
+}
+
+func (da *DiscordAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	if p.RunOnlyOnChannels {
+		return m.IsChannel
+	}
+	if p.RunOnlyOnDirectMessages {
+		return m.IsDirectMessage
+	}
+	if p.RunOnlyOnMentions {
+		return m.Mentioned
+	}
+	return true
+}
+
+// incoming returns the message for a MESSAGE_CREATE, the messages of the bot
+// itself are ignored.
+func (da *DiscordAdapter) incoming(dm discordMessage) (Message, bool) {
+	if dm.Author.ID == da.botID || dm.Content == "" {
+		return Message{}, false
+	}
+
+	mentioned := false
+	for _, u := range dm.Mentions {
+		mentioned = mentioned || u.ID == da.botID
+	}
+	return Message{
+		Emitter:  dm.Author.Username,
+		Receiver: dm.ChannelID,
+		Body:     dm.Content,
+		ID:       dm.ID,
+		// The direct messages are the only ones outside of a guild
+		IsChannel:       dm.GuildID != "",
+		IsDirectMessage: dm.GuildID == "",
+		Mentioned:       mentioned,
+		FromBot:         dm.Author.Bot,
+	}, true
+}
+
+func (da *DiscordAdapter) send(m Message) error {
+	channel := url.PathEscape(m.Receiver)
+	if m.Reaction != "" {
+		return da.call("PUT", "/channels/"+channel+"/messages/"+url.PathEscape(m.ID)+"/reactions/"+url.PathEscape(m.Reaction)+"/@me", nil, nil)
+	}
+
+	body := m.Body
+	if m.Format == plugin.FormatCode {
+		body = "```\n" + body + "\n```"
+	}
+	params := map[string]interface{}{"content": body}
+	if m.ReplyTo != "" {
+		params["message_reference"] = map[string]interface{}{"message_id": m.ReplyTo, "fail_if_not_exists": false}
+	}
+	return da.call("POST", "/channels/"+channel+"/messages", params, nil)
+}
+
+// gatewayURL returns where to connect, and if the session can be resumed.
+func (da *DiscordAdapter) gatewayURL() (string, bool) {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	if da.sessionID == "" || da.resumeURL == "" {
+		return da.options.GatewayURL, false
+	}
+
+	// The resume URL doesn't have the version & encoding of the gateway one
+	resumeURL, err := url.Parse(da.resumeURL)
+	if err != nil {
+		return da.options.GatewayURL, false
+	}
+	if gatewayURL, err := url.Parse(da.options.GatewayURL); err == nil && resumeURL.RawQuery == "" {
+		resumeURL.RawQuery = gatewayURL.RawQuery
+	}
+	if resumeURL.Path == "" {
+		resumeURL.Path = "/"
+	}
+	return resumeURL.String(), true
+}
+
+// heartbeat sends a heartbeat, unless the previous one wasn't acknowledged:
+// the connection is a zombie then.
+func (da *DiscordAdapter) heartbeat(ws *websocket.Conn, checkACK bool) error {
+	da.mu.Lock()
+	if checkACK && !da.acked {
+		da.mu.Unlock()
+		return errDiscordZombie
+	}
+	da.acked = false
+	seq := da.seq
+	da.mu.Unlock()
+
+	return websocket.JSON.Send(ws, map[string]interface{}{"op": discordHeartbeat, "d": seq})
+}
+
+// session connects to the gateway and receives its events until the
+// connection is lost.
+func (da *DiscordAdapter) session(stdinCh chan Message, ready func()) error {
+	gatewayURL, resume := da.gatewayURL()
+	config, err := websocket.NewConfig(gatewayURL, da.options.APIURL)
+	if err != nil {
+		return err
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	var hello discordPayload
+	if err := websocket.JSON.Receive(ws, &hello); err != nil {
+		return err
+	}
+	var helloData struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	if err := json.Unmarshal(hello.D, &helloData); err != nil || hello.Op != discordHello {
+		return fmt.Errorf("expected a hello from the Discord gateway, received: %+v", hello)
+	}
+
+	da.mu.Lock()
+	da.acked = true
+	if resume {
+		err = websocket.JSON.Send(ws, map[string]interface{}{
+			"op": discordResume,
+			"d":  map[string]interface{}{"token": da.options.Token, "session_id": da.sessionID, "seq": da.seq},
+		})
+	} else {
+		err = websocket.JSON.Send(ws, map[string]interface{}{
+			"op": discordIdentify,
+			"d": map[string]interface{}{
+				"token":      da.options.Token,
+				"intents":    discordIntents,
+				"properties": map[string]string{"os": "linux", "browser": "botella", "device": "botella"},
+			},
+		})
+	}
+	da.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The heartbeats are sent until this session is finished
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Duration(helloData.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := da.heartbeat(ws, true); err != nil {
+					// The reader is going to fail and reconnect
+					ws.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var p discordPayload
+		if err := websocket.JSON.Receive(ws, &p); err != nil {
+			return err
+		}
+		if p.S != nil {
+			da.mu.Lock()
+			da.seq = p.S
+			da.mu.Unlock()
+		}
+
+		switch p.Op {
+		case discordHeartbeat:
+			da.heartbeat(ws, false)
+		case discordHeartbeatACK:
+			da.mu.Lock()
+			da.acked = true
+			da.mu.Unlock()
+		case discordReconnect:
+			return errors.New("the Discord gateway asked to reconnect")
+		case discordInvalidSession:
+			var resumable bool
+			json.Unmarshal(p.D, &resumable)
+			if !resumable {
+				da.mu.Lock()
+				da.sessionID, da.resumeURL, da.seq = "", "", nil
+				da.mu.Unlock()
+			}
+			return errors.New("the Discord session is not valid anymore")
+		case discordDispatch:
+			switch p.T {
+			case "READY":
+				var r struct {
+					SessionID        string      `json:"session_id"`
+					ResumeGatewayURL string      `json:"resume_gateway_url"`
+					User             discordUser `json:"user"`
+				}
+				json.Unmarshal(p.D, &r)
+				da.mu.Lock()
+				da.sessionID, da.resumeURL = r.SessionID, r.ResumeGatewayURL
+				da.mu.Unlock()
+				ready()
+			case "RESUMED":
+				ready()
+			case "MESSAGE_CREATE":
+				var dm discordMessage
+				if err := json.Unmarshal(p.D, &dm); err != nil {
+					continue
+				}
+				if m, ok := da.incoming(dm); ok {
+					stdinCh <- m
+				}
+			}
+		}
+	}
+}
+
+func (da *DiscordAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	stdinCh := make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	go func() {
+		backoff := da.minBackoff
+		for {
+			err := da.session(stdinCh, func() { backoff = da.minBackoff })
+			stderrCh <- fmt.Errorf("Disconnected from the Discord gateway, reconnecting in %s: %v", backoff, err)
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > da.maxBackoff {
+				backoff = da.maxBackoff
+			}
+		}
+	}()
+
+	go func() {
+		for m := range stdoutCh {
+			if err := da.send(m); err != nil {
+				stderrCh <- err
+			}
+		}
+	}()
+
+	return stdinCh, stdoutCh, stderrCh
+}
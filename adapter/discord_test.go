@@ -0,0 +1,261 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+type discordRequest struct {
+	Method string
+	Path   string
+	Body   map[string]interface{}
+	At     time.Time
+}
+
+// fakeDiscord is a gateway that records what the bot sends on it and gives
+// its connections to conns, plus a REST API that records the requests.
+type fakeDiscord struct {
+	*httptest.Server
+
+	conns    chan *websocket.Conn
+	received chan discordPayload
+	requests chan discordRequest
+
+	mu sync.Mutex
+	// limited is how many requests are rate limited before accepting them
+	limited int
+}
+
+func newFakeDiscord() *fakeDiscord {
+	fd := &fakeDiscord{
+		conns:    make(chan *websocket.Conn, 10),
+		received: make(chan discordPayload, 100),
+		requests: make(chan discordRequest, 10),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/gateway", websocket.Handler(func(ws *websocket.Conn) {
+		websocket.JSON.Send(ws, map[string]interface{}{"op": discordHello, "d": map[string]interface{}{"heartbeat_interval": 50}})
+		fd.conns <- ws
+		for {
+			var p discordPayload
+			if err := websocket.JSON.Receive(ws, &p); err != nil {
+				return
+			}
+			switch p.Op {
+			case discordHeartbeat:
+				websocket.JSON.Send(ws, map[string]interface{}{"op": discordHeartbeatACK})
+			case discordIdentify:
+				websocket.JSON.Send(ws, map[string]interface{}{
+					"op": discordDispatch, "s": 1, "t": "READY",
+					"d": map[string]interface{}{
+						"session_id":         "s1",
+						"resume_gateway_url": "ws" + strings.TrimPrefix(fd.URL, "http") + "/gateway",
+						"user":               map[string]interface{}{"id": "42", "username": "botella"},
+					},
+				})
+			case discordResume:
+				websocket.JSON.Send(ws, map[string]interface{}{"op": discordDispatch, "t": "RESUMED"})
+			}
+			fd.received <- p
+		}
+	}))
+	mux.HandleFunc("/api/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "42", "username": "botella", "bot": true}`))
+	})
+	mux.HandleFunc("/api/channels/", func(w http.ResponseWriter, r *http.Request) {
+		fd.mu.Lock()
+		limited := fd.limited > 0
+		fd.limited--
+		fd.mu.Unlock()
+		if limited {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 0.01, "global": false}`))
+			return
+		}
+
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		fd.requests <- discordRequest{Method: r.Method, Path: strings.TrimPrefix(r.URL.EscapedPath(), "/api"), Body: body, At: time.Now()}
+		// Only one message can be sent every 100ms
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset-After", "0.1")
+		w.WriteHeader(http.StatusOK)
+	})
+	fd.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") && r.Header.Get("Authorization") != "Bot token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message": "401: Unauthorized", "code": 0}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return fd
+}
+
+func (fd *fakeDiscord) newAdapter(t *testing.T) *DiscordAdapter {
+	da, err := NewDiscord(DiscordOptions{
+		Token:      "token",
+		GatewayURL: "ws" + strings.TrimPrefix(fd.URL, "http") + "/gateway?v=10&encoding=json",
+		APIURL:     fd.URL + "/api/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	da.minBackoff = time.Millisecond
+	return da
+}
+
+// expect waits for the payload with the opcode, skipping the rest.
+func (fd *fakeDiscord) expect(t *testing.T, op int) map[string]interface{} {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-fd.received:
+			if p.Op == op {
+				var d map[string]interface{}
+				json.Unmarshal(p.D, &d)
+				return d
+			}
+		case <-timeout:
+			t.Fatalf("the opcode %d was never received", op)
+		}
+	}
+}
+
+func (fd *fakeDiscord) conn(t *testing.T) *websocket.Conn {
+	select {
+	case ws := <-fd.conns:
+		return ws
+	case <-time.After(5 * time.Second):
+		t.Fatal("the gateway was never connected")
+	}
+	return nil
+}
+
+func dispatchMessage(ws *websocket.Conn, seq int, message string) {
+	websocket.JSON.Send(ws, map[string]interface{}{"op": discordDispatch, "s": seq, "t": "MESSAGE_CREATE", "d": json.RawMessage(message)})
+}
+
+func TestDiscordGateway(t *testing.T) {
+	assert := assert.New(t)
+
+	fd := newFakeDiscord()
+	defer fd.Close()
+
+	da := fd.newAdapter(t)
+	assert.Equal("42", da.botID)
+	stdinCh, _, stderrCh := da.RunAndAttach()
+	// The disconnections are reported as errors
+	go func() {
+		for range stderrCh {
+		}
+	}()
+
+	ws := fd.conn(t)
+	identify := fd.expect(t, discordIdentify)
+	assert.Equal("token", identify["token"])
+	assert.Equal(float64(discordIntents), identify["intents"])
+
+	dispatchMessage(ws, 2, `{"id": "100", "channel_id": "C1", "guild_id": "G1", "author": {"id": "7", "username": "alex"}, "content": "hi <@42>", "mentions": [{"id": "42"}]}`)
+	dispatchMessage(ws, 3, `{"id": "101", "channel_id": "C1", "guild_id": "G1", "author": {"id": "42", "username": "botella", "bot": true}, "content": "my own reply"}`)
+	dispatchMessage(ws, 4, `{"id": "102", "channel_id": "D1", "author": {"id": "7", "username": "alex"}, "content": "ping", "mentions": []}`)
+	dispatchMessage(ws, 5, `{"id": "103", "channel_id": "C1", "guild_id": "G1", "author": {"id": "9", "username": "otherbot", "bot": true}, "content": "beep"}`)
+
+	assert.Equal(Message{Emitter: "alex", Receiver: "C1", Body: "hi <@42>", ID: "100", IsChannel: true, Mentioned: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "alex", Receiver: "D1", Body: "ping", ID: "102", IsDirectMessage: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "otherbot", Receiver: "C1", Body: "beep", ID: "103", IsChannel: true, FromBot: true}, <-stdinCh)
+
+	// The heartbeats carry the last sequence number
+	assert.Equal(5.0, func() interface{} {
+		for {
+			p := <-fd.received
+			if p.Op == discordHeartbeat {
+				var seq interface{}
+				json.Unmarshal(p.D, &seq)
+				if seq != nil {
+					return seq
+				}
+			}
+		}
+	}())
+
+	// After a disconnection the session is resumed where it was
+	websocket.JSON.Send(ws, map[string]interface{}{"op": discordReconnect})
+	ws = fd.conn(t)
+	resume := fd.expect(t, discordResume)
+	assert.Equal(map[string]interface{}{"token": "token", "session_id": "s1", "seq": 5.0}, resume)
+
+	dispatchMessage(ws, 6, `{"id": "104", "channel_id": "D1", "author": {"id": "7", "username": "alex"}, "content": "still there?"}`)
+	assert.Equal("still there?", (<-stdinCh).Body)
+
+	// An invalid session that can't be resumed starts a new one
+	websocket.JSON.Send(ws, map[string]interface{}{"op": discordInvalidSession, "d": false})
+	fd.conn(t)
+	fd.expect(t, discordIdentify)
+}
+
+func TestDiscordSend(t *testing.T) {
+	assert := assert.New(t)
+
+	fd := newFakeDiscord()
+	defer fd.Close()
+	// The first reply is rate limited
+	fd.limited = 1
+
+	da := fd.newAdapter(t)
+	_, stdoutCh, _ := da.RunAndAttach()
+
+	stdoutCh <- Message{Receiver: "C1", Body: "pong", ReplyTo: "100"}
+	first := <-fd.requests
+	assert.Equal("POST", first.Method)
+	assert.Equal("/channels/C1/messages", first.Path)
+	assert.Equal(map[string]interface{}{
+		"content":           "pong",
+		"message_reference": map[string]interface{}{"message_id": "100", "fail_if_not_exists": false},
+	}, first.Body)
+
+	// The rate limit of the route is respected
+	stdoutCh <- Message{Receiver: "C1", Body: "a < b", Format: plugin.FormatCode}
+	second := <-fd.requests
+	assert.Equal(map[string]interface{}{"content": "```\na < b\n```"}, second.Body)
+	assert.True(second.At.Sub(first.At) >= 90*time.Millisecond, "sent after %s", second.At.Sub(first.At))
+
+	stdoutCh <- Message{Receiver: "D1", ID: "102", Reaction: "👍"}
+	reaction := <-fd.requests
+	assert.Equal("PUT", reaction.Method)
+	assert.Equal("/channels/D1/messages/102/reactions/%F0%9F%91%8D/@me", reaction.Path)
+}
+
+func TestDiscordInvalidToken(t *testing.T) {
+	fd := newFakeDiscord()
+	defer fd.Close()
+
+	_, err := NewDiscord(DiscordOptions{Token: "wrong", APIURL: fd.URL + "/api"})
+	assert.EqualError(t, err, "Discord error (401): 401: Unauthorized")
+}
+
+func TestDiscordShouldRun(t *testing.T) {
+	assert := assert.New(t)
+
+	da := &DiscordAdapter{}
+	guild := &Message{Body: "hi", IsChannel: true}
+	dm := &Message{Body: "hi", IsDirectMessage: true}
+
+	assert.True(da.ShouldRun(&plugin.Plugin{}, guild))
+	assert.True(da.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, guild))
+	assert.False(da.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, dm))
+	assert.True(da.ShouldRun(&plugin.Plugin{RunOnlyOnDirectMessages: true}, dm))
+	assert.False(da.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, guild))
+	assert.True(da.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, &Message{Body: "hi", IsChannel: true, Mentioned: true}))
+}
@@ -1,58 +1,354 @@
 package adapter
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/twinj/uuid"
+	"golang.org/x/net/websocket"
 
 	"github.com/agonzalezro/botella/plugin"
 )
 
+// HTTPOptions are the options of the server of the HTTP adapter.
+type HTTPOptions struct {
+	Port int
+	// Bind is the address where the server listens, all of them if empty
+	Bind string
+	// PathPrefix is where the API is served, for example /bot
+	PathPrefix string
+
+	// CertFile and KeyFile are the paths of the TLS certificate and key,
+	// the server uses TLS if they are set.
+	CertFile string
+	KeyFile  string
+
+	// ReadTimeout and WriteTimeout limit the time reading the request and
+	// writing the response, the plugins need to finish before the second one.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Tokens are the bearer tokens accepted and HMACSecrets the secrets
+	// used to sign the requests, both by principal. If any of them is set
+	// the requests need to be authenticated.
+	Tokens      map[string]string
+	HMACSecrets map[string]string
+	// SignatureWindow is how old a signed request can be, 5m by default
+	SignatureWindow time.Duration
+
+	// JobsTTL is how long the results of the asynchronous requests are
+	// kept, 1h by default.
+	JobsTTL time.Duration
+}
+
 type HTTPAdapter struct {
-	port int
+	options HTTPOptions
+	server  *http.Server
+	auth    *authenticator
+
+	stdinCh chan Message
+
+	mu sync.Mutex
+	// pending are the requests waiting for the plugins, by receiver
+	pending map[string]*pendingRequest
+	// sessions are the streams open, by receiver
+	sessions map[string]*streamSession
+	// stopping is closed when the server is shut down, to finish the
+	// streams.
+	stopping chan struct{}
+
+	jobs            *jobStore
+	callbackClient  *http.Client
+	callbackBackoff time.Duration
+}
+
+// pendingRequest collects the results of the plugins run for a request.
+type pendingRequest struct {
+	results []Result
+	done    chan struct{}
+}
+
+// resultJSON is the result of a plugin on the JSON API.
+type resultJSON struct {
+	Plugin     string `json:"plugin"`
+	Image      string `json:"image,omitempty"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+func newResultJSON(r Result) resultJSON {
+	rj := resultJSON{
+		Plugin:     r.Plugin,
+		Image:      r.Image,
+		Stdout:     r.Stdout,
+		Stderr:     r.Stderr,
+		DurationMs: int64(r.Duration / time.Millisecond),
+	}
+	if r.Err != nil {
+		rj.Error = r.Err.Error()
+	}
+	return rj
 }
 
-func NewHTTP(port int) (*HTTPAdapter, error) {
-	return &HTTPAdapter{port}, nil
+func resultsJSON(results []Result) []resultJSON {
+	out := []resultJSON{}
+	for _, result := range results {
+		out = append(out, newResultJSON(result))
+	}
+	return out
 }
 
-func (HTTPAdapter) ShouldRun(_ *plugin.Plugin, _ *Message) bool {
+func NewHTTP(options HTTPOptions) (*HTTPAdapter, error) {
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, errors.New("the HTTP adapter needs both cert_file and key_file to use TLS")
+	}
+	options.PathPrefix = strings.TrimSuffix(options.PathPrefix, "/")
+	if options.PathPrefix != "" && !strings.HasPrefix(options.PathPrefix, "/") {
+		options.PathPrefix = "/" + options.PathPrefix
+	}
+
+	ha := &HTTPAdapter{
+		options:  options,
+		auth:     newAuthenticator(options.Tokens, options.HMACSecrets, options.SignatureWindow),
+		pending:  make(map[string]*pendingRequest),
+		sessions: make(map[string]*streamSession),
+		stopping: make(chan struct{}),
+
+		jobs:            newJobStore(options.JobsTTL),
+		callbackClient:  &http.Client{Timeout: 30 * time.Second},
+		callbackBackoff: time.Second,
+	}
+	ha.server = &http.Server{
+		Addr:         net.JoinHostPort(options.Bind, strconv.Itoa(options.Port)),
+		Handler:      ha.handler(),
+		ReadTimeout:  options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+	}
+	// Shutdown waits for the requests in course, but the streams don't
+	// finish by themselves.
+	ha.server.RegisterOnShutdown(func() { close(ha.stopping) })
+	return ha, nil
+}
+
+func (*HTTPAdapter) ShouldRun(_ *plugin.Plugin, _ *Message) bool {
 	// This adapter doesn't have permissions
 	return true
 }
 
-func (ha HTTPAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
-	stdinCh := make(chan Message, 1)
-	stdoutCh := make(chan Message, 1)
-	stderrCh := make(chan error, 1)
+func (ha *HTTPAdapter) Report(m Message, r Result) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	if pr, ok := ha.pending[m.Receiver]; ok {
+		pr.results = append(pr.results, r)
+	}
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			stderrCh <- err
+func (ha *HTTPAdapter) Done(m Message) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	if pr, ok := ha.pending[m.Receiver]; ok {
+		delete(ha.pending, m.Receiver)
+		close(pr.done)
+	}
+}
+
+// send sends the message to the plugins and waits for all of them. The
+// receiver of the message is used to identify the request, so it's replaced.
+func (ha *HTTPAdapter) send(ctx context.Context, m Message) ([]Result, error) {
+	m.Receiver = uuid.NewV4().String()
+	pr := &pendingRequest{done: make(chan struct{})}
+
+	ha.mu.Lock()
+	ha.pending[m.Receiver] = pr
+	ha.mu.Unlock()
+
+	forget := func() {
+		ha.mu.Lock()
+		delete(ha.pending, m.Receiver)
+		ha.mu.Unlock()
+	}
+
+	select {
+	case ha.stdinCh <- m:
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+
+	select {
+	case <-pr.done:
+		// Done was the last one touching the results
+		return pr.results, nil
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+}
+
+// handleMessage is the JSON API: it receives the emitter & body of a message
+// and replies with the results of every plugin.
+func (ha *HTTPAdapter) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var in struct {
+		Emitter string `json:"emitter"`
+		Body    string `json:"body"`
+		// Async requests reply with a job straight away, the results
+		// are posted to the callback URL (if any) when they are ready.
+		Async       bool   `json:"async"`
+		CallbackURL string `json:"callback_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("async") == "true" {
+		in.Async = true
+	}
+	if in.CallbackURL != "" {
+		if u, err := url.Parse(in.CallbackURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			http.Error(w, "Invalid callback_url", http.StatusBadRequest)
 			return
 		}
-		receiverID := uuid.NewV4().String()
-		stdinCh <- Message{Receiver: receiverID, Body: string(body)}
-
-		// FIXME: this loop isn't probably the best solution.
-		// FIXME #2: it will just return one plugin response.
-		for {
-			m := <-stdoutCh
-			if m.Receiver == receiverID {
-				w.Write([]byte(m.Body + "\n"))
-				return
+		in.Async = true
+	}
+
+	// The emitter is who was authenticated, if any
+	if principal := principalOf(r); principal != "" {
+		in.Emitter = principal
+	}
+	m := Message{Emitter: in.Emitter, Body: in.Body}
+
+	w.Header().Set("Content-Type", "application/json")
+	if in.Async {
+		j := ha.jobs.create(uuid.NewV4().String())
+		go func() {
+			results, _ := ha.send(context.Background(), m)
+			j := ha.jobs.finish(j.ID, resultsJSON(results))
+			if in.CallbackURL != "" {
+				ha.callback(in.CallbackURL, j)
 			}
-			stdoutCh <- m
+		}()
+
+		w.Header().Set("Location", ha.options.PathPrefix+"/v1/jobs/"+j.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(j)
+		return
+	}
+
+	results, err := ha.send(r.Context(), m)
+	if err != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(resultsJSON(results))
+}
+
+// handleJob replies with the status of an asynchronous request, and its
+// results once it's done.
+func (ha *HTTPAdapter) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	j, ok := ha.jobs.get(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
+
+// handleRaw receives the body of the message as it is and replies with the
+// body of every reply.
+func (ha *HTTPAdapter) handleRaw(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, err := ha.send(r.Context(), Message{Emitter: principalOf(r), Body: string(body)})
+	if err != nil {
+		return
+	}
+	for _, result := range results {
+		for _, reply := range result.Replies {
+			if reply.Reaction != "" {
+				// There is nothing to react to on HTTP
+				continue
+			}
+			w.Write([]byte(reply.Body + "\n"))
 		}
-	})
+	}
+}
+
+func (ha *HTTPAdapter) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/messages", ha.handleMessage)
+	mux.HandleFunc("/v1/jobs/", ha.handleJob)
+	mux.HandleFunc("/v1/events", ha.handleEvents)
+	mux.HandleFunc("/v1/sessions/", ha.handleSession)
+	// Any origin is accepted, the clients are not always browsers
+	mux.Handle("/v1/ws", websocket.Server{Handler: ha.handleWebSocket})
+	mux.HandleFunc("/", ha.handleRaw)
+	handler := ha.auth.wrap(mux)
+
+	if ha.options.PathPrefix == "" {
+		return handler
+	}
+	prefixed := http.NewServeMux()
+	prefixed.Handle(ha.options.PathPrefix+"/", http.StripPrefix(ha.options.PathPrefix, handler))
+	return prefixed
+}
+
+func (ha *HTTPAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	ha.stdinCh = make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	// The replies are collected with the results of the plugins, and
+	// pushed to the sessions open for their receiver.
+	go func() {
+		for m := range stdoutCh {
+			ha.deliver(m)
+		}
+	}()
 
 	go func() {
-		host := fmt.Sprintf(":%d", ha.port)
-		stderrCh <- http.ListenAndServe(host, nil)
+		var err error
+		if ha.options.CertFile != "" {
+			err = ha.server.ListenAndServeTLS(ha.options.CertFile, ha.options.KeyFile)
+		} else {
+			err = ha.server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			stderrCh <- err
+		}
 	}()
 
-	return stdinCh, stdoutCh, stderrCh
+	return ha.stdinCh, stdoutCh, stderrCh
+}
+
+// Stop stops the server, waiting a little bit for the requests in course.
+func (ha *HTTPAdapter) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return ha.server.Shutdown(ctx)
 }
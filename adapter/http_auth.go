@@ -0,0 +1,170 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	timestampHeader = "X-Botella-Timestamp"
+	signatureHeader = "X-Botella-Signature"
+
+	// defaultSignatureWindow is how old a signed request can be
+	defaultSignatureWindow = 5 * time.Minute
+)
+
+type principalKey struct{}
+
+// principalOf returns the principal authenticated for the request, empty if
+// the adapter doesn't use authentication.
+func principalOf(r *http.Request) string {
+	principal, _ := r.Context().Value(principalKey{}).(string)
+	return principal
+}
+
+// parsePrincipals parses a list of `principal:value` separated by commas, it
+// returns the values by principal.
+func parsePrincipals(s string) (map[string]string, error) {
+	principals := make(map[string]string)
+	for _, pv := range strings.Split(s, ",") {
+		if pv = strings.TrimSpace(pv); pv == "" {
+			continue
+		}
+		fragments := strings.SplitN(pv, ":", 2)
+		if len(fragments) < 2 || fragments[0] == "" || fragments[1] == "" {
+			return nil, fmt.Errorf("invalid principal, it should be in the form principal:value")
+		}
+		principals[fragments[0]] = fragments[1]
+	}
+	return principals, nil
+}
+
+// sign returns the signature of a request: the HMAC-SHA256 of the timestamp
+// and the body, separated by a dot.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticator checks the bearer tokens & the signatures of the requests.
+type authenticator struct {
+	// tokens and secrets are by principal
+	tokens  map[string]string
+	secrets map[string]string
+	window  time.Duration
+	now     func() time.Time
+
+	mu sync.Mutex
+	// seen are the signatures already used, to avoid replaying them inside
+	// the window.
+	seen map[string]time.Time
+}
+
+func newAuthenticator(tokens, secrets map[string]string, window time.Duration) *authenticator {
+	if window == 0 {
+		window = defaultSignatureWindow
+	}
+	return &authenticator{
+		tokens:  tokens,
+		secrets: secrets,
+		window:  window,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.tokens) > 0 || len(a.secrets) > 0
+}
+
+func (a *authenticator) bearer(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return "", false
+	}
+	for principal, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return principal, true
+		}
+	}
+	return "", false
+}
+
+// signed checks the signature of the request, the body is read and replaced.
+func (a *authenticator) signed(r *http.Request) (string, bool) {
+	timestamp, signature := r.Header.Get(timestampHeader), r.Header.Get(signatureHeader)
+	if timestamp == "" || signature == "" {
+		return "", false
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	now := a.now()
+	if age := now.Sub(time.Unix(seconds, 0)); age > a.window || age < -a.window {
+		return "", false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	for principal, secret := range a.secrets {
+		if hmac.Equal([]byte(sign(secret, timestamp, body)), []byte(signature)) {
+			return principal, a.firstUse(signature, now)
+		}
+	}
+	return "", false
+}
+
+// firstUse remembers the signature and checks that it wasn't used before.
+func (a *authenticator) firstUse(signature string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for s, t := range a.seen {
+		if now.Sub(t) > 2*a.window {
+			delete(a.seen, s)
+		}
+	}
+	if _, ok := a.seen[signature]; ok {
+		return false
+	}
+	a.seen[signature] = now
+	return true
+}
+
+// wrap only lets the authenticated requests go through, the principal is
+// added to their context.
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := a.bearer(r)
+		if !ok {
+			principal, ok = a.signed(r)
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
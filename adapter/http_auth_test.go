@@ -0,0 +1,96 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePrincipals(t *testing.T) {
+	assert := assert.New(t)
+
+	principals, err := parsePrincipals("ci:abc, alex:d:e:f,")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"ci": "abc", "alex": "d:e:f"}, principals)
+
+	principals, err = parsePrincipals("")
+	assert.NoError(err)
+	assert.Empty(principals)
+
+	_, err = parsePrincipals("abc")
+	assert.Error(err)
+	_, err = parsePrincipals("ci:")
+	assert.Error(err)
+}
+
+func TestHTTPAuthentication(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, _ := NewHTTP(HTTPOptions{
+		Tokens:      map[string]string{"ci": "s3cr3t"},
+		HMACSecrets: map[string]string{"github": "shh"},
+	})
+	ha.stdinCh = make(chan Message)
+	go fakeDispatcher(ha)
+	defer close(ha.stdinCh)
+	srv := httptest.NewServer(ha.server.Handler)
+	defer srv.Close()
+
+	body := `{"emitter": "someone", "body": "ping"}`
+	post := func(headers map[string]string, body string) (int, string) {
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/messages", strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+
+		var results []resultJSON
+		json.NewDecoder(resp.Body).Decode(&results)
+		if len(results) == 0 {
+			return resp.StatusCode, ""
+		}
+		return resp.StatusCode, results[0].Stdout
+	}
+
+	status, _ := post(nil, body)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	status, _ = post(map[string]string{"Authorization": "Bearer wrong"}, body)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	status, stdout := post(map[string]string{"Authorization": "Bearer s3cr3t"}, body)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("ci: ping", stdout, "the principal is the emitter")
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := map[string]string{
+		timestampHeader: timestamp,
+		signatureHeader: sign("shh", timestamp, []byte(body)),
+	}
+	status, stdout = post(signed, body)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("github: ping", stdout)
+
+	status, _ = post(signed, body)
+	assert.Equal(http.StatusUnauthorized, status, "replayed")
+
+	status, _ = post(signed, `{"body": "tampered"}`)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	status, _ = post(map[string]string{
+		timestampHeader: old,
+		signatureHeader: sign("shh", old, []byte(body)),
+	}, body)
+	assert.Equal(http.StatusUnauthorized, status, "too old")
+}
@@ -0,0 +1,134 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+
+	// defaultJobsTTL is how long a finished job is kept
+	defaultJobsTTL = time.Hour
+
+	// callbackAttempts is how many times a callback is tried
+	callbackAttempts = 5
+)
+
+// jobJSON is an asynchronous request on the JSON API.
+type jobJSON struct {
+	ID      string       `json:"id"`
+	Status  string       `json:"status"`
+	Results []resultJSON `json:"results,omitempty"`
+}
+
+type job struct {
+	jobJSON
+	finishedAt time.Time
+}
+
+// jobStore keeps the jobs in memory, the finished ones are forgotten after
+// the TTL.
+type jobStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobStore(ttl time.Duration) *jobStore {
+	if ttl == 0 {
+		ttl = defaultJobsTTL
+	}
+	return &jobStore{ttl: ttl, now: time.Now, jobs: make(map[string]*job)}
+}
+
+// pruneLocked forgets the expired jobs, the lock must be held.
+func (js *jobStore) pruneLocked() {
+	now := js.now()
+	for id, j := range js.jobs {
+		if j.Status == JobDone && now.Sub(j.finishedAt) > js.ttl {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+func (js *jobStore) create(id string) jobJSON {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.pruneLocked()
+
+	j := &job{jobJSON: jobJSON{ID: id, Status: JobRunning}}
+	js.jobs[id] = j
+	return j.jobJSON
+}
+
+func (js *jobStore) finish(id string, results []resultJSON) jobJSON {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	j, ok := js.jobs[id]
+	if !ok {
+		j = &job{jobJSON: jobJSON{ID: id}}
+		js.jobs[id] = j
+	}
+	j.Status, j.Results, j.finishedAt = JobDone, results, js.now()
+	return j.jobJSON
+}
+
+func (js *jobStore) get(id string) (jobJSON, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.pruneLocked()
+
+	j, ok := js.jobs[id]
+	if !ok {
+		return jobJSON{}, false
+	}
+	return j.jobJSON, true
+}
+
+// callback posts the finished job to the URL, retrying with backoff if it
+// doesn't get a 2xx.
+func (ha *HTTPAdapter) callback(url string, j jobJSON) {
+	body, err := json.Marshal(j)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	backoff := ha.callbackBackoff
+	for attempt := 1; ; attempt++ {
+		err := postJSON(ha.callbackClient, url, body)
+		if err == nil {
+			return
+		}
+		if attempt == callbackAttempts {
+			log.Errorf("Giving up on the callback of job %s to %s: %v", j.ID, url, err)
+			return
+		}
+		log.Warningf("Error on the callback of job %s to %s, retrying in %s: %v", j.ID, url, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postJSON(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received %d", resp.StatusCode)
+	}
+	return nil
+}
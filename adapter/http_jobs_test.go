@@ -0,0 +1,137 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobStoreTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	js := newJobStore(time.Minute)
+	js.now = func() time.Time { return now }
+
+	js.create("running")
+	js.create("done")
+	js.finish("done", []resultJSON{{Plugin: "echo"}})
+
+	j, ok := js.get("done")
+	assert.True(ok)
+	assert.Equal(JobDone, j.Status)
+	assert.Equal([]resultJSON{{Plugin: "echo"}}, j.Results)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = js.get("done")
+	assert.False(ok, "finished jobs are forgotten after the TTL")
+	j, ok = js.get("running")
+	assert.True(ok, "running jobs are kept")
+	assert.Equal(JobRunning, j.Status)
+}
+
+func getJob(t *testing.T, url string) (jobJSON, int) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var j jobJSON
+	json.NewDecoder(resp.Body).Decode(&j)
+	return j, resp.StatusCode
+}
+
+func TestHTTPAsyncJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, srv := newTestHTTP()
+	defer srv.Close()
+	defer close(ha.stdinCh)
+
+	resp, err := http.Post(srv.URL+"/v1/messages?async=true", "application/json", strings.NewReader(`{"emitter": "alex", "body": "ping"}`))
+	if !assert.NoError(err) {
+		return
+	}
+	var j jobJSON
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&j))
+	resp.Body.Close()
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+	assert.Equal("/v1/jobs/"+j.ID, resp.Header.Get("Location"))
+	assert.NotEmpty(j.ID)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for j.Status != JobDone && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		j, _ = getJob(t, srv.URL+resp.Header.Get("Location"))
+	}
+	if assert.Equal(JobDone, j.Status) && assert.Len(j.Results, 2) {
+		assert.Equal("alex: ping", j.Results[0].Stdout)
+		assert.Equal("exit status 1", j.Results[1].Error)
+	}
+
+	_, status := getJob(t, srv.URL+"/v1/jobs/unknown")
+	assert.Equal(http.StatusNotFound, status)
+
+	resp, err = http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(`{"body": "ping", "callback_url": "ftp://example.com"}`))
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestHTTPAsyncCallback(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	received := make(chan jobJSON, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		failing := attempts < 3
+		mu.Unlock()
+		if failing {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		var j jobJSON
+		json.NewDecoder(r.Body).Decode(&j)
+		received <- j
+	}))
+	defer callback.Close()
+
+	ha, srv := newTestHTTP()
+	defer srv.Close()
+	defer close(ha.stdinCh)
+	ha.callbackBackoff = time.Millisecond
+
+	resp, err := http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(`{"body": "ping", "callback_url": "`+callback.URL+`"}`))
+	if !assert.NoError(err) {
+		return
+	}
+	var accepted jobJSON
+	json.NewDecoder(resp.Body).Decode(&accepted)
+	resp.Body.Close()
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case j := <-received:
+		assert.Equal(accepted.ID, j.ID)
+		assert.Equal(JobDone, j.Status)
+		assert.Len(j.Results, 2)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback was never received")
+	}
+	mu.Lock()
+	assert.Equal(3, attempts)
+	mu.Unlock()
+}
@@ -0,0 +1,270 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/twinj/uuid"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// streamBuffer is how many replies can be waiting for a slow client
+	// before they start being dropped.
+	streamBuffer = 64
+
+	// streamKeepAlive is how often an idle SSE stream receives a comment,
+	// to avoid the proxies closing it.
+	streamKeepAlive = 30 * time.Second
+)
+
+// streamEvent is what the clients of the streams receive: the session when
+// they connect, and every reply sent to their receiver after that.
+type streamEvent struct {
+	// Type is session, message or error
+	Type     string `json:"type"`
+	Receiver string `json:"receiver,omitempty"`
+	Thread   string `json:"thread,omitempty"`
+	Body     string `json:"body,omitempty"`
+	Format   string `json:"format,omitempty"`
+	Reaction string `json:"reaction,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newMessageEvent(m Message) streamEvent {
+	return streamEvent{
+		Type:     "message",
+		Receiver: m.Receiver,
+		Thread:   m.Thread,
+		Body:     m.Body,
+		Format:   m.Format,
+		Reaction: m.Reaction,
+	}
+}
+
+var errSessionTaken = errors.New("the session belongs to someone else")
+
+// subscriber is a stream open for a receiver.
+type subscriber struct {
+	receiver string
+	out      chan Message
+}
+
+// streamSession are the streams open for a receiver, all of them by the
+// principal that opened the first one.
+type streamSession struct {
+	principal   string
+	subscribers map[*subscriber]struct{}
+}
+
+// subscribe opens a session for the receiver, a new one is generated if
+// it's empty. Several streams can share the same receiver, as long as they
+// are opened by the same principal.
+func (ha *HTTPAdapter) subscribe(receiver, principal string) (*subscriber, error) {
+	if receiver == "" {
+		receiver = uuid.NewV4().String()
+	}
+	s := &subscriber{receiver: receiver, out: make(chan Message, streamBuffer)}
+
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	session := ha.sessions[receiver]
+	if session == nil {
+		session = &streamSession{principal: principal, subscribers: make(map[*subscriber]struct{})}
+		ha.sessions[receiver] = session
+	}
+	if session.principal != principal {
+		return nil, errSessionTaken
+	}
+	session.subscribers[s] = struct{}{}
+	return s, nil
+}
+
+func (ha *HTTPAdapter) unsubscribe(s *subscriber) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	session := ha.sessions[s.receiver]
+	delete(session.subscribers, s)
+	if len(session.subscribers) == 0 {
+		delete(ha.sessions, s.receiver)
+	}
+}
+
+// hasSession checks if the principal has a session open for the receiver.
+func (ha *HTTPAdapter) hasSession(receiver, principal string) bool {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	session := ha.sessions[receiver]
+	return session != nil && session.principal == principal
+}
+
+// deliver pushes a reply to the streams open for its receiver, if any.
+func (ha *HTTPAdapter) deliver(m Message) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	session := ha.sessions[m.Receiver]
+	if session == nil {
+		return
+	}
+	for s := range session.subscribers {
+		select {
+		case s.out <- m:
+		default:
+			log.Warningf("Dropping a reply for the session %s, the client is not reading them", s.receiver)
+		}
+	}
+}
+
+// post sends a message of a session to the plugins without waiting for them,
+// their replies are delivered to the streams.
+func (ha *HTTPAdapter) post(ctx context.Context, m Message) error {
+	select {
+	case ha.stdinCh <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleEvents is the SSE stream of a session.
+func (ha *HTTPAdapter) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s, err := ha.subscribe(r.URL.Query().Get("receiver"), principalOf(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer ha.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	write := func(e streamEvent) {
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		flusher.Flush()
+	}
+	write(streamEvent{Type: "session", Receiver: s.receiver})
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case m := <-s.out:
+			write(newMessageEvent(m))
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-ha.stopping:
+			return
+		}
+	}
+}
+
+// handleSession receives the messages of the SSE sessions, the replies are
+// sent to the stream and not in the response.
+func (ha *HTTPAdapter) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The sessions of other principals are not found either
+	receiver := strings.TrimPrefix(r.URL.Path, "/v1/sessions/")
+	if !ha.hasSession(receiver, principalOf(r)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var in struct {
+		Emitter string `json:"emitter"`
+		Body    string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if principal := principalOf(r); principal != "" {
+		in.Emitter = principal
+	}
+
+	if err := ha.post(r.Context(), Message{Emitter: in.Emitter, Receiver: receiver, Body: in.Body}); err != nil {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleWebSocket is a session over a websocket: the messages are received
+// and the replies sent through it.
+func (ha *HTTPAdapter) handleWebSocket(ws *websocket.Conn) {
+	r := ws.Request()
+	s, err := ha.subscribe(r.URL.Query().Get("receiver"), principalOf(r))
+	if err != nil {
+		websocket.JSON.Send(ws, streamEvent{Type: "error", Error: err.Error()})
+		return
+	}
+	defer ha.unsubscribe(s)
+
+	if err := websocket.JSON.Send(ws, streamEvent{Type: "session", Receiver: s.receiver}); err != nil {
+		return
+	}
+
+	// The writer closes the websocket when the adapter is stopped, which
+	// makes the reader below fail.
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		defer ws.Close()
+		for {
+			select {
+			case m := <-s.out:
+				if err := websocket.JSON.Send(ws, newMessageEvent(m)); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			case <-ha.stopping:
+				return
+			}
+		}
+	}()
+
+	for {
+		var data string
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return
+		}
+
+		var in struct {
+			Emitter string `json:"emitter"`
+			Body    string `json:"body"`
+		}
+		if err := json.Unmarshal([]byte(data), &in); err != nil {
+			// The sends are safe to do from both goroutines
+			websocket.JSON.Send(ws, streamEvent{Type: "error", Error: fmt.Sprintf("Invalid JSON: %v", err)})
+			continue
+		}
+		if principal := principalOf(r); principal != "" {
+			in.Emitter = principal
+		}
+		if err := ha.post(r.Context(), Message{Emitter: in.Emitter, Receiver: s.receiver, Body: in.Body}); err != nil {
+			return
+		}
+	}
+}
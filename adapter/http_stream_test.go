@@ -0,0 +1,200 @@
+package adapter
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// newTestStreams returns an adapter whose plugins reply twice to every
+// message: straight away and a little bit later.
+func newTestStreams() (*HTTPAdapter, *httptest.Server) {
+	ha, _ := NewHTTP(HTTPOptions{})
+	ha.stdinCh = make(chan Message)
+	go func() {
+		for m := range ha.stdinCh {
+			ha.deliver(Message{Receiver: m.Receiver, Body: m.Emitter + ": " + m.Body})
+			go func(m Message) {
+				time.Sleep(10 * time.Millisecond)
+				ha.deliver(Message{Receiver: m.Receiver, Body: "later", Format: "markdown"})
+			}(m)
+		}
+	}()
+	return ha, httptest.NewServer(ha.handler())
+}
+
+// readEvent reads the next SSE event, skipping the comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, streamEvent) {
+	var (
+		name string
+		e    streamEvent
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+		case line == "" && name != "":
+			return name, e
+		}
+	}
+}
+
+func TestHTTPEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, srv := newTestStreams()
+	defer srv.Close()
+	defer close(ha.stdinCh)
+
+	resp, err := http.Get(srv.URL + "/v1/events?receiver=web-1")
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	name, e := readEvent(t, r)
+	assert.Equal("session", name)
+	assert.Equal(streamEvent{Type: "session", Receiver: "web-1"}, e)
+
+	post, err := http.Post(srv.URL+"/v1/sessions/web-1", "application/json", strings.NewReader(`{"emitter": "alex", "body": "ping"}`))
+	if assert.NoError(err) {
+		post.Body.Close()
+		assert.Equal(http.StatusAccepted, post.StatusCode)
+	}
+
+	name, e = readEvent(t, r)
+	assert.Equal("message", name)
+	assert.Equal(streamEvent{Type: "message", Receiver: "web-1", Body: "alex: ping"}, e)
+	_, e = readEvent(t, r)
+	assert.Equal(streamEvent{Type: "message", Receiver: "web-1", Body: "later", Format: "markdown"}, e)
+
+	post, err = http.Post(srv.URL+"/v1/sessions/unknown", "application/json", strings.NewReader(`{"body": "ping"}`))
+	if assert.NoError(err) {
+		post.Body.Close()
+		assert.Equal(http.StatusNotFound, post.StatusCode)
+	}
+
+	// The streams are finished when the adapter is stopped
+	close(ha.stopping)
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream wasn't finished")
+	}
+}
+
+func TestHTTPWebSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, srv := newTestStreams()
+	defer srv.Close()
+	defer close(ha.stdinCh)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/ws", "", srv.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var e streamEvent
+	assert.NoError(websocket.JSON.Receive(ws, &e))
+	assert.Equal("session", e.Type)
+	receiver := e.Receiver
+	assert.NotEmpty(receiver, "a receiver is generated if there isn't any")
+
+	assert.NoError(websocket.Message.Send(ws, `{"emitter": "alex", "body": "ping"}`))
+	assert.NoError(websocket.JSON.Receive(ws, &e))
+	assert.Equal(streamEvent{Type: "message", Receiver: receiver, Body: "alex: ping"}, e)
+	e = streamEvent{}
+	assert.NoError(websocket.JSON.Receive(ws, &e))
+	assert.Equal(streamEvent{Type: "message", Receiver: receiver, Body: "later", Format: "markdown"}, e)
+
+	assert.NoError(websocket.Message.Send(ws, `{"body":`))
+	e = streamEvent{}
+	assert.NoError(websocket.JSON.Receive(ws, &e))
+	assert.Equal("error", e.Type)
+
+	// The replies are only delivered to the streams of their receiver
+	ha.deliver(Message{Receiver: "someone-else", Body: "not for you"})
+	ha.deliver(Message{Receiver: receiver, Reaction: "+1"})
+	e = streamEvent{}
+	assert.NoError(websocket.JSON.Receive(ws, &e))
+	assert.Equal(streamEvent{Type: "message", Receiver: receiver, Reaction: "+1"}, e)
+}
+
+func TestHTTPSessionsByPrincipal(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, _ := NewHTTP(HTTPOptions{Tokens: map[string]string{"alex": "alex-token", "sam": "sam-token"}})
+	ha.stdinCh = make(chan Message, 1)
+	srv := httptest.NewServer(ha.handler())
+	defer srv.Close()
+
+	request := func(method, path, token, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	events := request("GET", "/v1/events?receiver=web-1", "alex-token", "")
+	defer events.Body.Close()
+	name, _ := readEvent(t, bufio.NewReader(events.Body))
+	assert.Equal("session", name)
+
+	// Somebody else can't read the replies of the session nor write on it
+	other := request("GET", "/v1/events?receiver=web-1", "sam-token", "")
+	other.Body.Close()
+	assert.Equal(http.StatusForbidden, other.StatusCode)
+
+	post := request("POST", "/v1/sessions/web-1", "sam-token", `{"body": "ping"}`)
+	post.Body.Close()
+	assert.Equal(http.StatusNotFound, post.StatusCode)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/ws?receiver=web-1", "", srv.URL)
+	assert.Error(err, "the websocket needs a token too")
+	config, _ := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/ws?receiver=web-1", srv.URL)
+	config.Header.Set("Authorization", "Bearer sam-token")
+	if ws, err = websocket.DialConfig(config); assert.NoError(err) {
+		defer ws.Close()
+		ws.SetDeadline(time.Now().Add(5 * time.Second))
+		var e streamEvent
+		assert.NoError(websocket.JSON.Receive(ws, &e))
+		assert.Equal(streamEvent{Type: "error", Error: errSessionTaken.Error()}, e)
+	}
+
+	// Its owner can
+	post = request("POST", "/v1/sessions/web-1", "alex-token", `{"body": "ping"}`)
+	post.Body.Close()
+	assert.Equal(http.StatusAccepted, post.StatusCode)
+	assert.Equal(Message{Emitter: "alex", Receiver: "web-1", Body: "ping"}, <-ha.stdinCh)
+}
@@ -0,0 +1,171 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDispatcher answers every message like two plugins would do, except
+// the ones with "nothing" as body.
+func fakeDispatcher(ha *HTTPAdapter) {
+	for m := range ha.stdinCh {
+		if m.Body != "nothing" {
+			ha.Report(m, Result{
+				Plugin:   "echo",
+				Image:    "agonzalezro/botella-test",
+				Stdout:   m.Emitter + ": " + m.Body,
+				Duration: 1500 * time.Millisecond,
+				Replies:  []Message{{Receiver: m.Receiver, Body: m.Body}, {Receiver: m.Receiver, Reaction: "+1"}},
+			})
+			ha.Report(m, Result{
+				Plugin: "broken",
+				Stderr: "boom",
+				Err:    errors.New("exit status 1"),
+			})
+		}
+		go ha.Done(m)
+	}
+}
+
+func newTestHTTP() (*HTTPAdapter, *httptest.Server) {
+	ha, _ := NewHTTP(HTTPOptions{})
+	ha.stdinCh = make(chan Message)
+	go fakeDispatcher(ha)
+	return ha, httptest.NewServer(ha.handler())
+}
+
+func TestHTTPMessagesAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, srv := newTestHTTP()
+	defer srv.Close()
+	defer close(ha.stdinCh)
+
+	resp, err := http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(`{"emitter": "alex", "body": "ping"}`))
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	var results []map[string]interface{}
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&results))
+	assert.Equal([]map[string]interface{}{
+		{"plugin": "echo", "image": "agonzalezro/botella-test", "stdout": "alex: ping", "stderr": "", "duration_ms": 1500.0},
+		{"plugin": "broken", "stdout": "", "stderr": "boom", "error": "exit status 1", "duration_ms": 0.0},
+	}, results)
+
+	resp, err = http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(`{"body": "nothing"}`))
+	if assert.NoError(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal("[]\n", string(body))
+	}
+
+	resp, err = http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(`{"body":`))
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/v1/messages")
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestHTTPRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, srv := newTestHTTP()
+	defer srv.Close()
+	defer close(ha.stdinCh)
+
+	// Concurrent requests get their own replies
+	errs := make(chan error)
+	for _, body := range []string{"hi", "bye", "ping", "pong"} {
+		go func(body string) {
+			resp, err := http.Post(srv.URL, "text/plain", strings.NewReader(body))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			if string(b) != body+"\n" {
+				err = errors.New("unexpected reply for " + body + ": " + string(b))
+			}
+			errs <- err
+		}(body)
+	}
+	for i := 0; i < 4; i++ {
+		assert.NoError(<-errs)
+	}
+	assert.Empty(ha.pending)
+}
+
+func TestHTTPPathPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	ha, _ := NewHTTP(HTTPOptions{PathPrefix: "bot/"})
+	ha.stdinCh = make(chan Message)
+	go fakeDispatcher(ha)
+	defer close(ha.stdinCh)
+	srv := httptest.NewServer(ha.server.Handler)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/bot/v1/messages", "application/json", strings.NewReader(`{"body": "nothing"}`))
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/v1/messages", "application/json", strings.NewReader(`{"body": "nothing"}`))
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestHTTPServerAndStop(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewHTTP(HTTPOptions{CertFile: "cert.pem"})
+	assert.Error(err)
+
+	ha, err := NewHTTP(HTTPOptions{Bind: "127.0.0.1", Port: 0, ReadTimeout: time.Second})
+	assert.NoError(err)
+	assert.Equal("127.0.0.1:0", ha.server.Addr)
+	assert.Equal(time.Second, ha.server.ReadTimeout)
+
+	_, _, stderrCh := ha.RunAndAttach()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(ha.Stop())
+	select {
+	case err := <-stderrCh:
+		t.Errorf("unexpected error after stopping: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewHTTPFromEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := New("http", map[string]string{"port": "8080", "bind": "localhost", "write_timeout": "1m"})
+	if assert.NoError(err) {
+		ha := a.(*HTTPAdapter)
+		assert.Equal("localhost:8080", ha.server.Addr)
+		assert.Equal(time.Minute, ha.server.WriteTimeout)
+	}
+
+	_, err = New("http", map[string]string{"port": "8080", "read_timeout": "forever"})
+	assert.Error(err)
+}
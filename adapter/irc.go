@@ -0,0 +1,502 @@
+package adapter
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+const (
+	// ircLineLimit is the maximum length of a line on the protocol,
+	// including the CRLF.
+	ircLineLimit = 512
+	// ircMaxHost is the longest host the server could add to our prefix when
+	// it relays our messages.
+	ircMaxHost = 63
+
+	// defaultLineDelay is the time waited between the lines of a reply, the
+	// servers disconnect the clients that flood them.
+	defaultLineDelay = 500 * time.Millisecond
+
+	// ircRegisterTimeout limits the time waiting for the server to accept
+	// the connection.
+	ircRegisterTimeout = 30 * time.Second
+)
+
+var errIRCDisconnected = errors.New("disconnected from IRC")
+
+// IRCOptions are the server and the identity of the bot on IRC.
+type IRCOptions struct {
+	// Server is the host:port of the IRC server
+	Server string
+	TLS    bool
+	// Password is the password of the server, if it has one
+	Password string
+
+	Nick     string
+	User     string
+	RealName string
+	// SASLUser and SASLPassword, if set, are used to authenticate with SASL
+	// PLAIN.
+	SASLUser     string
+	SASLPassword string
+
+	// Channels are joined on every connection
+	Channels []string
+}
+
+type IRCAdapter struct {
+	options   IRCOptions
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	// nick is the nick given by the server, it could be different than the
+	// one of the options if it was taken.
+	nick string
+	// connected is closed while there is a connection
+	connected chan struct{}
+
+	pingInterval           time.Duration
+	minBackoff, maxBackoff time.Duration
+	lineDelay              time.Duration
+}
+
+// ircMessage is a line of the protocol: [:prefix] command params... [:trailing]
+type ircMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+func parseIRCMessage(line string) ircMessage {
+	var m ircMessage
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		// The tags are not used
+		if i := strings.Index(line, " "); i >= 0 {
+			line = strings.TrimLeft(line[i+1:], " ")
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return ircMessage{Prefix: line[1:]}
+		}
+		m.Prefix, line = line[1:i], strings.TrimLeft(line[i+1:], " ")
+	}
+
+	var trailing string
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		line, trailing, hasTrailing = line[:i], line[i+2:], true
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		m.Command, m.Params = strings.ToUpper(fields[0]), fields[1:]
+	}
+	if hasTrailing {
+		m.Params = append(m.Params, trailing)
+	}
+	return m
+}
+
+// nick returns the nick of the prefix nick!user@host.
+func (m ircMessage) nick() string {
+	if i := strings.Index(m.Prefix, "!"); i >= 0 {
+		return m.Prefix[:i]
+	}
+	return m.Prefix
+}
+
+func (m ircMessage) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+func isIRCChannel(target string) bool {
+	return target != "" && strings.ContainsAny(target[:1], "#&+!")
+}
+
+// splitIRCLine splits a line in chunks of max bytes at most, on spaces when
+// possible and never in the middle of a character.
+func splitIRCLine(line string, max int) []string {
+	var chunks []string
+	for len(line) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// The limit is smaller than a character
+			cut = max
+		}
+		// A space right after the limit is a good place to split too
+		if i := strings.LastIndex(line[:cut+1], " "); i > 0 {
+			cut = i
+		}
+		chunks = append(chunks, line[:cut])
+		line = strings.TrimLeft(line[cut:], " ")
+	}
+	if line != "" {
+		chunks = append(chunks, line)
+	}
+	return chunks
+}
+
+func NewIRC(options IRCOptions) (*IRCAdapter, error) {
+	return newIRC(options, nil)
+}
+
+func newIRC(options IRCOptions, tlsConfig *tls.Config) (*IRCAdapter, error) {
+	if options.User == "" {
+		options.User = options.Nick
+	}
+	if options.RealName == "" {
+		options.RealName = "botella"
+	}
+	ia := &IRCAdapter{
+		options:      options,
+		tlsConfig:    tlsConfig,
+		connected:    make(chan struct{}),
+		pingInterval: defaultPingInterval,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		lineDelay:    defaultLineDelay,
+	}
+	if err := ia.connect(); err != nil {
+		return nil, err
+	}
+	return ia, nil
+}
+
+func (ia *IRCAdapter) dial() (net.Conn, error) {
+	if !ia.options.TLS {
+		return net.Dial("tcp", ia.options.Server)
+	}
+	config := ia.tlsConfig
+	if config == nil {
+		host, _, err := net.SplitHostPort(ia.options.Server)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{ServerName: host}
+	}
+	return tls.Dial("tcp", ia.options.Server, config)
+}
+
+// connect connects to the server, registers the bot and joins the channels.
+func (ia *IRCAdapter) connect() error {
+	conn, err := ia.dial()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+
+	nick, err := ia.register(conn, r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	for _, channel := range ia.options.Channels {
+		if _, err := fmt.Fprintf(conn, "JOIN %s\r\n", channel); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	ia.conn, ia.reader, ia.nick = conn, r, nick
+	close(ia.connected)
+	return nil
+}
+
+// register does the registration of the connection, with SASL if needed,
+// and returns the nick given by the server.
+func (ia *IRCAdapter) register(conn net.Conn, r *bufio.Reader) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(ircRegisterTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	send := func(format string, a ...interface{}) error {
+		_, err := fmt.Fprintf(conn, format+"\r\n", a...)
+		return err
+	}
+
+	nick := ia.options.Nick
+	sasl := ia.options.SASLUser != ""
+	if ia.options.Password != "" {
+		send("PASS %s", ia.options.Password)
+	}
+	if sasl {
+		send("CAP REQ :sasl")
+	}
+	send("NICK %s", nick)
+	if err := send("USER %s 0 * :%s", ia.options.User, ia.options.RealName); err != nil {
+		return "", err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		m := parseIRCMessage(line)
+		switch m.Command {
+		case "PING":
+			send("PONG :%s", m.param(0))
+		case "CAP":
+			switch m.param(1) {
+			case "ACK":
+				send("AUTHENTICATE PLAIN")
+			case "NAK":
+				return "", errors.New("the IRC server doesn't support SASL")
+			}
+		case "AUTHENTICATE":
+			if m.param(0) == "+" {
+				credentials := ia.options.SASLUser + "\x00" + ia.options.SASLUser + "\x00" + ia.options.SASLPassword
+				send("AUTHENTICATE %s", base64.StdEncoding.EncodeToString([]byte(credentials)))
+			}
+		case "903": // RPL_SASLSUCCESS
+			send("CAP END")
+		case "902", "904", "905", "906": // the SASL errors
+			return "", fmt.Errorf("SASL authentication failed: %s", m.param(len(m.Params)-1))
+		case "433": // ERR_NICKNAMEINUSE
+			nick += "_"
+			send("NICK %s", nick)
+		case "001": // RPL_WELCOME
+			return m.param(0), nil
+		case "ERROR":
+			return "", fmt.Errorf("the IRC server closed the connection: %s", m.param(0))
+		}
+	}
+}
+
+// current returns the connection and its reader, they are nil while
+// disconnected.
+func (ia *IRCAdapter) current() (net.Conn, *bufio.Reader) {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	return ia.conn, ia.reader
+}
+
+// self returns the nick of the bot, it could change after reconnecting.
+func (ia *IRCAdapter) self() string {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	return ia.nick
+}
+
+// waitConnected returns a channel that is closed once there is a connection.
+func (ia *IRCAdapter) waitConnected() chan struct{} {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	return ia.connected
+}
+
+// drop closes the connection if it's still the current one.
+func (ia *IRCAdapter) drop(conn net.Conn) {
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	if conn == nil || ia.conn != conn {
+		return
+	}
+	conn.Close()
+	ia.conn, ia.reader = nil, nil
+	ia.connected = make(chan struct{})
+}
+
+// reconnect drops the connection and connects again, waiting a little bit
+// more after every failed attempt.
+func (ia *IRCAdapter) reconnect(conn net.Conn, stderrCh chan error) {
+	ia.drop(conn)
+
+	backoff := ia.minBackoff
+	for {
+		err := ia.connect()
+		if err == nil {
+			log.Info("Reconnected to IRC.")
+			return
+		}
+		stderrCh <- fmt.Errorf("Error reconnecting to IRC, retrying in %s: %v", backoff, err)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > ia.maxBackoff {
+			backoff = ia.maxBackoff
+		}
+	}
+}
+
+// write sends a line to the server. The connection is dropped if it fails,
+// the reader connects again.
+func (ia *IRCAdapter) write(format string, a ...interface{}) error {
+	conn, _ := ia.current()
+	if conn == nil {
+		return errIRCDisconnected
+	}
+	// Every line is written at once, so they can be written concurrently
+	if _, err := fmt.Fprintf(conn, format+"\r\n", a...); err != nil {
+		ia.drop(conn)
+		return errIRCDisconnected
+	}
+	return nil
+}
+
+func (ia *IRCAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	if p.RunOnlyOnChannels {
+		return m.IsChannel
+	}
+	if p.RunOnlyOnDirectMessages {
+		return m.IsDirectMessage
+	}
+	if p.RunOnlyOnMentions {
+		return strings.Contains(strings.ToLower(m.Body), strings.ToLower(ia.self()))
+	}
+	return true
+}
+
+// incoming returns the message for a PRIVMSG, the rest of lines and the
+// messages of the bot itself are ignored.
+func (ia *IRCAdapter) incoming(m ircMessage) (Message, bool) {
+	if m.Command != "PRIVMSG" || len(m.Params) < 2 || strings.EqualFold(m.nick(), ia.self()) {
+		return Message{}, false
+	}
+
+	body := m.Params[1]
+	if strings.HasPrefix(body, "\x01") {
+		// Only the actions (/me) are taken into account from all the CTCP
+		if !strings.HasPrefix(body, "\x01ACTION ") {
+			return Message{}, false
+		}
+		body = strings.TrimSuffix(strings.TrimPrefix(body, "\x01ACTION "), "\x01")
+	}
+
+	target := m.Params[0]
+	if !isIRCChannel(target) {
+		// The replies to the direct messages go to whoever sent them
+		target = m.nick()
+	}
+	return Message{
+		Emitter:         m.nick(),
+		Receiver:        target,
+		Body:            body,
+		IsChannel:       isIRCChannel(m.Params[0]),
+		IsDirectMessage: !isIRCChannel(m.Params[0]),
+	}, true
+}
+
+// maxPayload is the longest text that can be sent to the target in a line,
+// the server adds our prefix to it when it relays it.
+func (ia *IRCAdapter) maxPayload(target string) int {
+	prefix := len(":"+ia.self()+"!"+ia.options.User+"@") + ircMaxHost + len(" ")
+	return ircLineLimit - len("\r\n") - len("PRIVMSG "+target+" :") - prefix
+}
+
+// chunks returns the lines that need to be sent for the message, none for
+// the reactions because there are no reactions on IRC.
+func (ia *IRCAdapter) chunks(m Message) []string {
+	if m.Reaction != "" {
+		return nil
+	}
+
+	var chunks []string
+	max := ia.maxPayload(m.Receiver)
+	for _, line := range strings.Split(m.Body, "\n") {
+		chunks = append(chunks, splitIRCLine(strings.TrimRight(line, "\r"), max)...)
+	}
+	return chunks
+}
+
+// send sends the chunks to the target and returns how many were sent.
+func (ia *IRCAdapter) send(target string, chunks []string) (int, error) {
+	for i, chunk := range chunks {
+		if i > 0 {
+			time.Sleep(ia.lineDelay)
+		}
+		if err := ia.write("PRIVMSG %s :%s", target, chunk); err != nil {
+			return i, err
+		}
+	}
+	return len(chunks), nil
+}
+
+func (ia *IRCAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	stdinCh := make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	go func() {
+		for {
+			conn, r := ia.current()
+			if conn == nil {
+				// A write failed and dropped the connection
+				ia.reconnect(nil, stderrCh)
+				continue
+			}
+			// Something (at least the pongs) is received on every interval
+			conn.SetReadDeadline(time.Now().Add(2 * ia.pingInterval))
+			line, err := r.ReadString('\n')
+			if err != nil {
+				stderrCh <- err
+				ia.reconnect(conn, stderrCh)
+				continue
+			}
+
+			m := parseIRCMessage(line)
+			switch m.Command {
+			case "PING":
+				ia.write("PONG :%s", m.param(0))
+			case "ERROR":
+				// The server is going to close the connection
+				ia.reconnect(conn, stderrCh)
+			default:
+				if message, ok := ia.incoming(m); ok {
+					stdinCh <- message
+				}
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(ia.pingInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// The reader is going to notice if it fails
+			ia.write("PING :botella")
+		}
+	}()
+
+	go func() {
+		for m := range stdoutCh {
+			// The replies sent while disconnected wait for the
+			// reconnection instead of being lost, and go on from the
+			// chunk that failed.
+			chunks := ia.chunks(m)
+			sent, err := ia.send(m.Receiver, chunks)
+			for err == errIRCDisconnected {
+				<-ia.waitConnected()
+				chunks = chunks[sent:]
+				sent, err = ia.send(m.Receiver, chunks)
+			}
+			if err != nil {
+				stderrCh <- err
+			}
+		}
+	}()
+
+	return stdinCh, stdoutCh, stderrCh
+}
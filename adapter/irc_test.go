@@ -0,0 +1,312 @@
+package adapter
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+// fakeIRC is an IRC server that registers the clients (with SASL if they ask
+// for it) and gives access to what they send.
+type fakeIRC struct {
+	listener net.Listener
+	// taken are the nicks already in use
+	taken map[string]bool
+	// sasl is the base64 of the only credentials accepted
+	sasl string
+
+	conns chan net.Conn
+	lines chan string
+}
+
+func newFakeIRC(t *testing.T, listener net.Listener) *fakeIRC {
+	fi := &fakeIRC{
+		listener: listener,
+		taken:    map[string]bool{"taken": true},
+		sasl:     base64.StdEncoding.EncodeToString([]byte("bot\x00bot\x00secret")),
+		conns:    make(chan net.Conn, 10),
+		lines:    make(chan string, 100),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fi.conns <- conn
+			go fi.serve(conn)
+		}
+	}()
+	return fi
+}
+
+func (fi *fakeIRC) serve(conn net.Conn) {
+	var (
+		nick                       string
+		user, capPending, welcomed bool
+	)
+	welcome := func() {
+		if nick != "" && user && !capPending && !welcomed {
+			welcomed = true
+			fmt.Fprintf(conn, ":fake 001 %s :Welcome\r\n", nick)
+		}
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fi.lines <- line
+
+		m := parseIRCMessage(line)
+		switch m.Command {
+		case "CAP":
+			if m.param(0) == "REQ" {
+				capPending = true
+				fmt.Fprint(conn, ":fake CAP * ACK :sasl\r\n")
+			} else if m.param(0) == "END" {
+				capPending = false
+			}
+		case "AUTHENTICATE":
+			switch m.param(0) {
+			case "PLAIN":
+				fmt.Fprint(conn, "AUTHENTICATE +\r\n")
+			case fi.sasl:
+				fmt.Fprint(conn, ":fake 903 * :SASL authentication successful\r\n")
+			default:
+				fmt.Fprint(conn, ":fake 904 * :SASL authentication failed\r\n")
+			}
+		case "NICK":
+			if fi.taken[m.param(0)] {
+				fmt.Fprintf(conn, ":fake 433 * %s :Nickname is already in use\r\n", m.param(0))
+				continue
+			}
+			nick = m.param(0)
+		case "USER":
+			user = true
+		}
+		welcome()
+	}
+}
+
+// expect waits for a line sent to the fake server, skipping the rest.
+func (fi *fakeIRC) expect(t *testing.T, prefix string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-fi.lines:
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("%q was never sent", prefix)
+		}
+	}
+}
+
+func TestParseIRCMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	m := parseIRCMessage(":alex!a@example.com PRIVMSG #botella :hi there :)\r\n")
+	assert.Equal(ircMessage{Prefix: "alex!a@example.com", Command: "PRIVMSG", Params: []string{"#botella", "hi there :)"}}, m)
+	assert.Equal("alex", m.nick())
+
+	assert.Equal(ircMessage{Command: "PING", Params: []string{"irc.example.com"}}, parseIRCMessage("PING :irc.example.com"))
+	assert.Equal(ircMessage{Prefix: "fake", Command: "001", Params: []string{"bot", "Welcome"}}, parseIRCMessage("@time=2020 :fake 001 bot :Welcome"))
+}
+
+func TestSplitIRCLine(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"short"}, splitIRCLine("short", 10))
+	assert.Equal([]string{"one two", "three four", "five"}, splitIRCLine("one two three four five", 10))
+	assert.Equal([]string{"abcdefghij", "klm"}, splitIRCLine("abcdefghijklm", 10))
+	// The characters are never split
+	assert.Equal([]string{"ñññ", "ñ"}, splitIRCLine("ññññ", 7))
+	assert.Empty(splitIRCLine("", 10))
+}
+
+func TestIRC(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	fi := newFakeIRC(t, listener)
+
+	ia, err := newIRC(IRCOptions{
+		Server:       listener.Addr().String(),
+		Nick:         "taken",
+		User:         "botella",
+		SASLUser:     "bot",
+		SASLPassword: "secret",
+		Channels:     []string{"#botella", "#ops"},
+	}, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	ia.lineDelay = 0
+	assert.Equal("taken_", ia.self(), "the nick was taken")
+
+	fi.expect(t, "CAP REQ :sasl")
+	fi.expect(t, "AUTHENTICATE PLAIN")
+	assert.Equal("AUTHENTICATE "+fi.sasl, fi.expect(t, "AUTHENTICATE "))
+	fi.expect(t, "CAP END")
+	fi.expect(t, "JOIN #botella")
+	fi.expect(t, "JOIN #ops")
+
+	stdinCh, stdoutCh, _ := ia.RunAndAttach()
+	conn := <-fi.conns
+	fmt.Fprint(conn, ":alex!a@example.com PRIVMSG #botella :hi taken_\r\n")
+	fmt.Fprint(conn, ":taken_!botella@example.com PRIVMSG #botella :my own message\r\n")
+	fmt.Fprint(conn, ":alex!a@example.com NOTICE #botella :a notice\r\n")
+	fmt.Fprint(conn, ":alex!a@example.com PRIVMSG taken_ :\x01ACTION waves\x01\r\n")
+	fmt.Fprint(conn, "PING :fake\r\n")
+
+	assert.Equal(Message{Emitter: "alex", Receiver: "#botella", Body: "hi taken_", IsChannel: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "alex", Receiver: "alex", Body: "waves", IsDirectMessage: true}, <-stdinCh)
+	fi.expect(t, "PONG :fake")
+
+	long := strings.TrimSpace(strings.Repeat("word ", 200))
+	stdoutCh <- Message{Receiver: "#botella", Body: "first\n" + long}
+	stdoutCh <- Message{Receiver: "#botella", Reaction: "+1"}
+	stdoutCh <- Message{Receiver: "alex", Body: "last"}
+
+	assert.Equal("PRIVMSG #botella :first", fi.expect(t, "PRIVMSG"))
+	var sent string
+	for {
+		line := fi.expect(t, "PRIVMSG")
+		if line == "PRIVMSG alex :last" {
+			break
+		}
+		// The line relayed by the server needs to fit in the limit
+		relayed := ":taken_!botella@" + strings.Repeat("h", ircMaxHost) + " " + line + "\r\n"
+		assert.True(len(relayed) <= ircLineLimit, "the line is too long: %d", len(relayed))
+		sent += strings.TrimPrefix(line, "PRIVMSG #botella :") + " "
+	}
+	assert.Equal(long, strings.TrimSuffix(sent, " "))
+}
+
+func TestIRCReconnects(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	fi := newFakeIRC(t, listener)
+
+	ia, err := newIRC(IRCOptions{Server: listener.Addr().String(), Nick: "bot", Channels: []string{"#botella"}}, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	ia.minBackoff, ia.maxBackoff = time.Millisecond, time.Millisecond
+	fi.expect(t, "JOIN #botella")
+
+	stdinCh, stdoutCh, stderrCh := ia.RunAndAttach()
+	(<-fi.conns).Close()
+	<-stderrCh
+
+	// The channels are joined again on the new connection
+	conn := <-fi.conns
+	fi.expect(t, "JOIN #botella")
+	fmt.Fprint(conn, ":alex!a@example.com PRIVMSG #botella :still there?\r\n")
+	assert.Equal(Message{Emitter: "alex", Receiver: "#botella", Body: "still there?", IsChannel: true}, <-stdinCh)
+
+	stdoutCh <- Message{Receiver: "#botella", Body: "yes"}
+	fi.expect(t, "PRIVMSG #botella :yes")
+}
+
+// flakyConn is a connection whose writes fail after a few of them.
+type flakyConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if c.writes == 0 {
+		c.Conn.Close()
+		return 0, errors.New("broken pipe")
+	}
+	c.writes--
+	return c.Conn.Write(b)
+}
+
+func TestIRCResumesAfterAFailedWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	fi := newFakeIRC(t, listener)
+
+	ia, err := newIRC(IRCOptions{Server: listener.Addr().String(), Nick: "bot", Channels: []string{"#botella"}}, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	ia.minBackoff, ia.maxBackoff, ia.lineDelay = time.Millisecond, time.Millisecond, 0
+	fi.expect(t, "JOIN #botella")
+	// Only the first line of the reply is written
+	ia.conn = &flakyConn{Conn: ia.conn, writes: 1}
+
+	_, stdoutCh, stderrCh := ia.RunAndAttach()
+	go func() {
+		for range stderrCh {
+		}
+	}()
+
+	stdoutCh <- Message{Receiver: "#botella", Body: "one\ntwo\nthree"}
+	assert.Equal("PRIVMSG #botella :one", fi.expect(t, "PRIVMSG"))
+	// The rest is sent after reconnecting, without repeating the first line
+	fi.expect(t, "JOIN #botella")
+	assert.Equal("PRIVMSG #botella :two", fi.expect(t, "PRIVMSG"))
+	assert.Equal("PRIVMSG #botella :three", fi.expect(t, "PRIVMSG"))
+}
+
+func TestIRCWithTLSAndWrongSASL(t *testing.T) {
+	assert := assert.New(t)
+
+	// The certificate of httptest is valid for 127.0.0.1
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	listener, _ := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates})
+	defer listener.Close()
+	fi := newFakeIRC(t, listener)
+	clientConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	options := IRCOptions{Server: listener.Addr().String(), TLS: true, Nick: "bot", Channels: []string{"#botella"}}
+	if _, err := newIRC(options, clientConfig); assert.NoError(err) {
+		fi.expect(t, "JOIN #botella")
+	}
+
+	options.SASLUser, options.SASLPassword = "bot", "wrong"
+	_, err := newIRC(options, clientConfig)
+	assert.EqualError(err, "SASL authentication failed: SASL authentication failed")
+}
+
+func TestIRCShouldRun(t *testing.T) {
+	assert := assert.New(t)
+
+	ia := &IRCAdapter{nick: "Botella"}
+	channel := &Message{Body: "hi", IsChannel: true}
+	dm := &Message{Body: "hi", IsDirectMessage: true}
+	mention := &Message{Body: "botella: hi", IsChannel: true}
+
+	assert.True(ia.ShouldRun(&plugin.Plugin{}, channel))
+	assert.True(ia.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, channel))
+	assert.False(ia.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, dm))
+	assert.True(ia.ShouldRun(&plugin.Plugin{RunOnlyOnDirectMessages: true}, dm))
+	assert.True(ia.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, mention))
+	assert.False(ia.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, channel))
+}
@@ -0,0 +1,414 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+// defaultSyncTimeout is how long the homeserver holds a sync request when
+// there is nothing new.
+const defaultSyncTimeout = 30 * time.Second
+
+// MatrixOptions are the homeserver and the account of the bot on Matrix.
+type MatrixOptions struct {
+	// Homeserver is the URL of the homeserver, for example https://matrix.org
+	Homeserver  string
+	AccessToken string
+	// AutoJoin makes the bot join the rooms where it's invited
+	AutoJoin bool
+	// SinceFile is where the position of the sync is kept between runs, the
+	// messages received while botella was stopped are lost without it.
+	SinceFile string
+}
+
+type MatrixAdapter struct {
+	options MatrixOptions
+	client  *http.Client
+	userID  string
+
+	mu sync.Mutex
+	// since is the position of the sync
+	since string
+	// direct are the rooms that are direct chats and members the number of
+	// members joined to every room.
+	direct  map[string]bool
+	members map[string]int
+	txnID   int
+
+	syncTimeout            time.Duration
+	minBackoff, maxBackoff time.Duration
+}
+
+type matrixEvent struct {
+	Type     string          `json:"type"`
+	EventID  string          `json:"event_id"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key,omitempty"`
+	Content  json.RawMessage `json:"content"`
+}
+
+type matrixRelation struct {
+	RelType string `json:"rel_type"`
+	EventID string `json:"event_id"`
+}
+
+type matrixMessageContent struct {
+	MsgType   string          `json:"msgtype"`
+	Body      string          `json:"body"`
+	RelatesTo *matrixRelation `json:"m.relates_to,omitempty"`
+}
+
+type matrixSync struct {
+	NextBatch   string `json:"next_batch"`
+	AccountData struct {
+		Events []matrixEvent `json:"events"`
+	} `json:"account_data"`
+	Rooms struct {
+		Join map[string]struct {
+			Summary struct {
+				JoinedMemberCount *int `json:"m.joined_member_count"`
+			} `json:"summary"`
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+// matrixError is the error returned by the homeserver.
+type matrixError struct {
+	Status       int
+	ErrCode      string `json:"errcode"`
+	Message      string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("Matrix error (%d): %s %s", e.Status, e.ErrCode, e.Message)
+}
+
+func NewMatrix(options MatrixOptions) (*MatrixAdapter, error) {
+	options.Homeserver = strings.TrimSuffix(options.Homeserver, "/")
+	ma := &MatrixAdapter{
+		options: options,
+		// The sync requests are held by the homeserver for a while
+		client:      &http.Client{Timeout: defaultSyncTimeout + 30*time.Second},
+		direct:      make(map[string]bool),
+		members:     make(map[string]int),
+		syncTimeout: defaultSyncTimeout,
+		minBackoff:  defaultMinBackoff,
+		maxBackoff:  defaultMaxBackoff,
+	}
+
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := ma.call("GET", "/account/whoami", nil, &whoami); err != nil {
+		return nil, err
+	}
+	ma.userID = whoami.UserID
+
+	if options.SinceFile != "" {
+		since, err := ioutil.ReadFile(options.SinceFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ma.since = strings.TrimSpace(string(since))
+	}
+	return ma, nil
+}
+
+// call calls the client-server API, the response is decoded on out unless
+// it's nil.
+func (ma *MatrixAdapter) call(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for {
+		req, err := http.NewRequest(method, ma.options.Homeserver+"/_matrix/client/v3"+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+ma.options.AccessToken)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := ma.client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			e := &matrixError{Status: resp.StatusCode}
+			json.Unmarshal(data, e)
+			if e.ErrCode == "M_LIMIT_EXCEEDED" && e.RetryAfterMs > 0 {
+				time.Sleep(time.Duration(e.RetryAfterMs) * time.Millisecond)
+				continue
+			}
+			return e
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	}
+}
+
+// localpart returns the user part of the ID of the bot: botella from
+// @botella:example.com
+func (ma *MatrixAdapter) localpart() string {
+	id := strings.TrimPrefix(ma.userID, "@")
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+func (ma *MatrixAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	if p.RunOnlyOnChannels {
+		return m.IsChannel
+	}
+	if p.RunOnlyOnDirectMessages {
+		return m.IsDirectMessage
+	}
+	if p.RunOnlyOnMentions {
+		body := strings.ToLower(m.Body)
+		return strings.Contains(body, strings.ToLower(ma.userID)) || strings.Contains(body, strings.ToLower(ma.localpart()))
+	}
+	return true
+}
+
+// isDirect checks if the room is a direct chat, because it's marked as one or
+// because there are only two members on it. The lock must be held.
+func (ma *MatrixAdapter) isDirect(room string) bool {
+	return ma.direct[room] || ma.members[room] == 2
+}
+
+// handleSync keeps what's needed from the sync and returns the messages
+// received and the rooms where the bot was invited. The messages of the
+// first sync are ignored, they were written before botella was running.
+func (ma *MatrixAdapter) handleSync(s matrixSync, first bool) ([]Message, []string) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.since = s.NextBatch
+
+	for _, e := range s.AccountData.Events {
+		if e.Type != "m.direct" {
+			continue
+		}
+		var direct map[string][]string
+		json.Unmarshal(e.Content, &direct)
+		for _, rooms := range direct {
+			for _, room := range rooms {
+				ma.direct[room] = true
+			}
+		}
+	}
+
+	var invites []string
+	for room, invite := range s.Rooms.Invite {
+		for _, e := range invite.InviteState.Events {
+			if e.Type != "m.room.member" || e.StateKey == nil || *e.StateKey != ma.userID {
+				continue
+			}
+			var content struct {
+				IsDirect bool `json:"is_direct"`
+			}
+			json.Unmarshal(e.Content, &content)
+			if content.IsDirect {
+				ma.direct[room] = true
+			}
+		}
+		invites = append(invites, room)
+	}
+
+	var messages []Message
+	for room, joined := range s.Rooms.Join {
+		if count := joined.Summary.JoinedMemberCount; count != nil {
+			ma.members[room] = *count
+		}
+		if first {
+			continue
+		}
+
+		for _, e := range joined.Timeline.Events {
+			if e.Type != "m.room.message" || e.Sender == ma.userID {
+				continue
+			}
+			var content matrixMessageContent
+			if err := json.Unmarshal(e.Content, &content); err != nil {
+				continue
+			}
+
+			m := Message{
+				Emitter:  e.Sender,
+				Receiver: room,
+				Body:     content.Body,
+				ID:       e.EventID,
+				// The notices are the messages of the bots
+				FromBot:         content.MsgType == "m.notice",
+				IsChannel:       !ma.isDirect(room),
+				IsDirectMessage: ma.isDirect(room),
+			}
+			if r := content.RelatesTo; r != nil {
+				switch r.RelType {
+				case "m.replace":
+					// The edits are not new messages
+					continue
+				case "m.thread":
+					m.Thread = r.EventID
+				}
+			}
+			messages = append(messages, m)
+		}
+	}
+	return messages, invites
+}
+
+// sync long polls the homeserver for whatever happened since the last one.
+func (ma *MatrixAdapter) sync() (matrixSync, bool, error) {
+	ma.mu.Lock()
+	since := ma.since
+	ma.mu.Unlock()
+
+	params := url.Values{}
+	params.Set("timeout", fmt.Sprint(int64(ma.syncTimeout/time.Millisecond)))
+	if since != "" {
+		params.Set("since", since)
+	}
+
+	var s matrixSync
+	err := ma.call("GET", "/sync?"+params.Encode(), nil, &s)
+	return s, since == "", err
+}
+
+func (ma *MatrixAdapter) join(room string) error {
+	return ma.call("POST", "/join/"+url.PathEscape(room), struct{}{}, nil)
+}
+
+// saveSince keeps the position of the sync on the since file, if any.
+func (ma *MatrixAdapter) saveSince() error {
+	if ma.options.SinceFile == "" {
+		return nil
+	}
+	ma.mu.Lock()
+	since := ma.since
+	ma.mu.Unlock()
+	return ioutil.WriteFile(ma.options.SinceFile, []byte(since+"\n"), 0600)
+}
+
+func (ma *MatrixAdapter) nextTxnID() string {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.txnID++
+	return fmt.Sprintf("botella-%d-%d", time.Now().UnixNano(), ma.txnID)
+}
+
+func (ma *MatrixAdapter) send(m Message) error {
+	if strings.HasPrefix(m.Receiver, "@") {
+		return fmt.Errorf("Matrix replies can only be sent to rooms, not to users: %s", m.Receiver)
+	}
+	room := url.PathEscape(m.Receiver)
+
+	if m.Reaction != "" {
+		content := map[string]interface{}{
+			"m.relates_to": map[string]string{"rel_type": "m.annotation", "event_id": m.ID, "key": m.Reaction},
+		}
+		return ma.call("PUT", "/rooms/"+room+"/send/m.reaction/"+ma.nextTxnID(), content, nil)
+	}
+
+	// The replies are notices, so the rest of bots don't reply to them
+	content := map[string]interface{}{"msgtype": "m.notice", "body": m.Body}
+	if m.Format == plugin.FormatCode {
+		content["format"] = "org.matrix.custom.html"
+		content["formatted_body"] = "<pre><code>" + html.EscapeString(m.Body) + "</code></pre>"
+	}
+	if m.Thread != "" {
+		content["m.relates_to"] = map[string]interface{}{
+			"rel_type": "m.thread",
+			"event_id": m.Thread,
+			// The clients without threads show it as a reply
+			"is_falling_back": true,
+			"m.in_reply_to":   map[string]string{"event_id": m.Thread},
+		}
+	}
+	return ma.call("PUT", "/rooms/"+room+"/send/m.room.message/"+ma.nextTxnID(), content, nil)
+}
+
+func (ma *MatrixAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	stdinCh := make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	go func() {
+		backoff := ma.minBackoff
+		for {
+			s, first, err := ma.sync()
+			if err != nil {
+				stderrCh <- fmt.Errorf("Error syncing with Matrix, retrying in %s: %v", backoff, err)
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > ma.maxBackoff {
+					backoff = ma.maxBackoff
+				}
+				continue
+			}
+			backoff = ma.minBackoff
+
+			messages, invites := ma.handleSync(s, first)
+			if err := ma.saveSince(); err != nil {
+				stderrCh <- err
+			}
+			for _, room := range invites {
+				if !ma.options.AutoJoin {
+					log.Infof("Invited to the Matrix room %s, but auto_join is disabled.", room)
+					continue
+				}
+				if err := ma.join(room); err != nil {
+					stderrCh <- err
+				}
+			}
+			for _, m := range messages {
+				stdinCh <- m
+			}
+		}
+	}()
+
+	go func() {
+		for m := range stdoutCh {
+			if err := ma.send(m); err != nil {
+				stderrCh <- err
+			}
+		}
+	}()
+
+	return stdinCh, stdoutCh, stderrCh
+}
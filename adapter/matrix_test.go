@@ -0,0 +1,220 @@
+package adapter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+type matrixRequest struct {
+	Path    string
+	Content map[string]interface{}
+}
+
+// fakeMatrix is a homeserver that answers the syncs with whatever is sent to
+// syncs, and records the rest of the requests.
+type fakeMatrix struct {
+	*httptest.Server
+
+	syncs chan string
+	joins chan string
+	sent  chan matrixRequest
+	// limited is how many sends are rate limited before accepting them
+	limited int
+}
+
+func newFakeMatrix() *fakeMatrix {
+	fm := &fakeMatrix{
+		syncs: make(chan string),
+		joins: make(chan string, 10),
+		sent:  make(chan matrixRequest, 10),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/client/v3/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"user_id": "@botella:example.com"}`))
+	})
+	mux.HandleFunc("/_matrix/client/v3/sync", func(w http.ResponseWriter, r *http.Request) {
+		since := r.URL.Query().Get("since")
+		select {
+		case s := <-fm.syncs:
+			w.Write([]byte(s))
+		case <-time.After(20 * time.Millisecond):
+			w.Write([]byte(`{"next_batch": "` + since + `"}`))
+		}
+	})
+	mux.HandleFunc("/_matrix/client/v3/join/", func(w http.ResponseWriter, r *http.Request) {
+		fm.joins <- strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3/join/")
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("/_matrix/client/v3/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		if fm.limited > 0 {
+			fm.limited--
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 1}`))
+			return
+		}
+		var content map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&content)
+		// The transaction ID changes on every request
+		path := r.URL.Path[:strings.LastIndex(r.URL.Path, "/")]
+		fm.sent <- matrixRequest{Path: strings.TrimPrefix(path, "/_matrix/client/v3"), Content: content}
+		w.Write([]byte(`{"event_id": "$reply"}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"}`))
+	})
+	fm.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer syt_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return fm
+}
+
+func textEvent(id, sender, content string) string {
+	return `{"type": "m.room.message", "event_id": "` + id + `", "sender": "` + sender + `", "content": ` + content + `}`
+}
+
+func TestMatrix(t *testing.T) {
+	assert := assert.New(t)
+
+	fm := newFakeMatrix()
+	defer fm.Close()
+	// The first reply is rate limited
+	fm.limited = 1
+	dir, _ := ioutil.TempDir("", "botella")
+	defer os.RemoveAll(dir)
+	sinceFile := filepath.Join(dir, "since")
+
+	ma, err := NewMatrix(MatrixOptions{Homeserver: fm.URL + "/", AccessToken: "syt_token", AutoJoin: true, SinceFile: sinceFile})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("@botella:example.com", ma.userID)
+	stdinCh, stdoutCh, _ := ma.RunAndAttach()
+
+	// The messages of the first sync are old, they are not run
+	fm.syncs <- `{
+		"next_batch": "s1",
+		"account_data": {"events": [{"type": "m.direct", "content": {"@alex:example.com": ["!dm:example.com"]}}]},
+		"rooms": {
+			"join": {"!room:example.com": {
+				"summary": {"m.joined_member_count": 5},
+				"timeline": {"events": [` + textEvent("$old", "@alex:example.com", `{"msgtype": "m.text", "body": "old"}`) + `]}
+			}},
+			"invite": {"!new:example.com": {"invite_state": {"events": [
+				{"type": "m.room.member", "state_key": "@botella:example.com", "sender": "@bob:example.com", "content": {"membership": "invite", "is_direct": true}}
+			]}}}
+		}
+	}`
+	assert.Equal("!new:example.com", <-fm.joins)
+
+	fm.syncs <- `{
+		"next_batch": "s2",
+		"rooms": {"join": {
+			"!room:example.com": {"timeline": {"events": [
+				` + textEvent("$1", "@alex:example.com", `{"msgtype": "m.text", "body": "hi botella"}`) + `,
+				` + textEvent("$2", "@botella:example.com", `{"msgtype": "m.notice", "body": "my own reply"}`) + `,
+				` + textEvent("$3", "@alex:example.com", `{"msgtype": "m.text", "body": "* hi botella!", "m.relates_to": {"rel_type": "m.replace", "event_id": "$1"}}`) + `,
+				` + textEvent("$4", "@alex:example.com", `{"msgtype": "m.text", "body": "in a thread", "m.relates_to": {"rel_type": "m.thread", "event_id": "$1"}}`) + `,
+				` + textEvent("$5", "@otherbot:example.com", `{"msgtype": "m.notice", "body": "beep"}`) + `,
+				{"type": "m.room.member", "event_id": "$6", "sender": "@carol:example.com", "state_key": "@carol:example.com", "content": {"membership": "join"}}
+			]}},
+			"!dm:example.com": {"timeline": {"events": [` + textEvent("$7", "@alex:example.com", `{"msgtype": "m.text", "body": "ping"}`) + `]}}
+		}}
+	}`
+
+	received := make(map[string]Message)
+	for i := 0; i < 4; i++ {
+		m := <-stdinCh
+		received[m.ID] = m
+	}
+	assert.Equal(map[string]Message{
+		"$1": {Emitter: "@alex:example.com", Receiver: "!room:example.com", Body: "hi botella", ID: "$1", IsChannel: true},
+		"$4": {Emitter: "@alex:example.com", Receiver: "!room:example.com", Body: "in a thread", ID: "$4", Thread: "$1", IsChannel: true},
+		"$5": {Emitter: "@otherbot:example.com", Receiver: "!room:example.com", Body: "beep", ID: "$5", FromBot: true, IsChannel: true},
+		"$7": {Emitter: "@alex:example.com", Receiver: "!dm:example.com", Body: "ping", ID: "$7", IsDirectMessage: true},
+	}, received)
+
+	since, _ := ioutil.ReadFile(sinceFile)
+	assert.Equal("s2\n", string(since))
+
+	stdoutCh <- Message{Receiver: "!room:example.com", Thread: "$1", Body: "pong"}
+	assert.Equal(matrixRequest{
+		Path: "/rooms/!room:example.com/send/m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.notice",
+			"body":    "pong",
+			"m.relates_to": map[string]interface{}{
+				"rel_type":        "m.thread",
+				"event_id":        "$1",
+				"is_falling_back": true,
+				"m.in_reply_to":   map[string]interface{}{"event_id": "$1"},
+			},
+		},
+	}, <-fm.sent)
+
+	stdoutCh <- Message{Receiver: "!dm:example.com", Body: "a < b", Format: plugin.FormatCode}
+	assert.Equal(matrixRequest{
+		Path: "/rooms/!dm:example.com/send/m.room.message",
+		Content: map[string]interface{}{
+			"msgtype":        "m.notice",
+			"body":           "a < b",
+			"format":         "org.matrix.custom.html",
+			"formatted_body": "<pre><code>a &lt; b</code></pre>",
+		},
+	}, <-fm.sent)
+
+	stdoutCh <- Message{Receiver: "!dm:example.com", ID: "$7", Reaction: "👍"}
+	assert.Equal(matrixRequest{
+		Path: "/rooms/!dm:example.com/send/m.reaction",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": "$7", "key": "👍"},
+		},
+	}, <-fm.sent)
+
+	// After a restart the sync continues where it was
+	ma, err = NewMatrix(MatrixOptions{Homeserver: fm.URL, AccessToken: "syt_token", SinceFile: sinceFile})
+	if assert.NoError(err) {
+		assert.Equal("s2", ma.since)
+	}
+}
+
+func TestMatrixInvalidToken(t *testing.T) {
+	fm := newFakeMatrix()
+	defer fm.Close()
+
+	_, err := NewMatrix(MatrixOptions{Homeserver: fm.URL, AccessToken: "wrong"})
+	assert.EqualError(t, err, "Matrix error (401): M_UNKNOWN_TOKEN Invalid access token")
+}
+
+func TestMatrixShouldRun(t *testing.T) {
+	assert := assert.New(t)
+
+	ma := &MatrixAdapter{userID: "@botella:example.com"}
+	room := &Message{Body: "hi", IsChannel: true}
+	dm := &Message{Body: "hi", IsDirectMessage: true}
+
+	assert.True(ma.ShouldRun(&plugin.Plugin{}, room))
+	assert.True(ma.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, room))
+	assert.False(ma.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, dm))
+	assert.True(ma.ShouldRun(&plugin.Plugin{RunOnlyOnDirectMessages: true}, dm))
+	assert.False(ma.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, room))
+	assert.True(ma.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, &Message{Body: "Botella: hi"}))
+	assert.True(ma.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, &Message{Body: "@botella:example.com hi"}))
+}
@@ -0,0 +1,312 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+// MattermostOptions are the server and the personal access token of the bot
+// account on Mattermost.
+type MattermostOptions struct {
+	// URL is where the server is, for example https://mattermost.example.com
+	URL   string
+	Token string
+}
+
+type MattermostAdapter struct {
+	options MattermostOptions
+	client  *http.Client
+	botID   string
+
+	// seq is the number of the last action sent on the websocket
+	mu  sync.Mutex
+	seq int
+
+	minBackoff, maxBackoff time.Duration
+}
+
+type mattermostEvent struct {
+	Event string `json:"event"`
+	Data  struct {
+		ChannelType string `json:"channel_type"`
+		SenderName  string `json:"sender_name"`
+		// Post and Mentions are JSON encoded inside of the event
+		Post     string `json:"post"`
+		Mentions string `json:"mentions"`
+	} `json:"data"`
+
+	// The replies to the actions sent by the bot
+	Status   string `json:"status"`
+	SeqReply int    `json:"seq_reply"`
+	Error    *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type mattermostPost struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	UserID    string `json:"user_id"`
+	RootID    string `json:"root_id"`
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	Props     struct {
+		FromBot interface{} `json:"from_bot"`
+	} `json:"props"`
+}
+
+// mattermostError is an error returned by the REST API.
+type mattermostError struct {
+	Status  int
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+func (e *mattermostError) Error() string {
+	return fmt.Sprintf("Mattermost error (%d): %s", e.Status, e.Message)
+}
+
+func NewMattermost(options MattermostOptions) (*MattermostAdapter, error) {
+	options.URL = strings.TrimSuffix(options.URL, "/")
+	ma := &MattermostAdapter{
+		options:    options,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+
+	var me struct {
+		ID string `json:"id"`
+	}
+	if err := ma.call("GET", "/users/me", nil, &me); err != nil {
+		return nil, err
+	}
+	ma.botID = me.ID
+	return ma, nil
+}
+
+// call calls the REST API, the response is decoded on out unless it's nil.
+func (ma *MattermostAdapter) call(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for {
+		req, err := http.NewRequest(method, ma.options.URL+"/api/v4"+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+ma.options.Token)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := ma.client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// X-Ratelimit-Reset is how many seconds until the next request
+			// is accepted.
+			reset := secondsHeader(resp.Header, "X-Ratelimit-Reset")
+			if reset <= 0 {
+				reset = time.Second
+			}
+			time.Sleep(reset)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			e := &mattermostError{Status: resp.StatusCode}
+			json.Unmarshal(data, e)
+			return e
+		}
+
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	}
+}
+
+func (ma *MattermostAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	if p.RunOnlyOnChannels {
+		return m.IsChannel
+	}
+	if p.RunOnlyOnDirectMessages {
+		return m.IsDirectMessage
+	}
+	if p.RunOnlyOnMentions {
+		return m.Mentioned
+	}
+	return true
+}
+
+// incoming returns the message of a posted event, the posts of the bot itself
+// and the ones of the system (somebody joined, ...) are ignored.
+func (ma *MattermostAdapter) incoming(e mattermostEvent) (Message, bool) {
+	var post mattermostPost
+	if err := json.Unmarshal([]byte(e.Data.Post), &post); err != nil {
+		return Message{}, false
+	}
+	if post.UserID == ma.botID || post.Type != "" || post.Message == "" {
+		return Message{}, false
+	}
+
+	var mentions []string
+	json.Unmarshal([]byte(e.Data.Mentions), &mentions)
+	mentioned := false
+	for _, id := range mentions {
+		mentioned = mentioned || id == ma.botID
+	}
+
+	emitter := strings.TrimPrefix(e.Data.SenderName, "@")
+	if emitter == "" {
+		emitter = post.UserID
+	}
+	// The type is O for public channels, P for private ones, D for direct
+	// messages and G for group messages.
+	channelType := e.Data.ChannelType
+	return Message{
+		Emitter:         emitter,
+		Receiver:        post.ChannelID,
+		Body:            post.Message,
+		ID:              post.ID,
+		Thread:          post.RootID,
+		IsChannel:       channelType == "O" || channelType == "P",
+		IsDirectMessage: channelType == "D" || channelType == "G",
+		Mentioned:       mentioned,
+		// It's a bool or a string depending on who created the post
+		FromBot: fmt.Sprint(post.Props.FromBot) == "true",
+	}, true
+}
+
+func (ma *MattermostAdapter) send(m Message) error {
+	if m.Reaction != "" {
+		return ma.call("POST", "/reactions", map[string]string{
+			"user_id":    ma.botID,
+			"post_id":    m.ID,
+			"emoji_name": strings.Trim(m.Reaction, ":"),
+		}, nil)
+	}
+
+	body := m.Body
+	if m.Format == plugin.FormatCode {
+		body = "```\n" + body + "\n```"
+	}
+	post := map[string]string{"channel_id": m.Receiver, "message": body}
+	if m.Thread != "" {
+		post["root_id"] = m.Thread
+	}
+	return ma.call("POST", "/posts", post, nil)
+}
+
+// websocketURL returns the URL of the websocket of the server, ws:// or wss://
+// depending on the one of the server.
+func (ma *MattermostAdapter) websocketURL() string {
+	u := ma.options.URL
+	if strings.HasPrefix(u, "https://") {
+		u = "wss://" + strings.TrimPrefix(u, "https://")
+	} else {
+		u = "ws://" + strings.TrimPrefix(u, "http://")
+	}
+	return u + "/api/v4/websocket"
+}
+
+// session connects to the websocket, authenticates and receives the events
+// until the connection is lost.
+func (ma *MattermostAdapter) session(stdinCh chan Message, ready func()) error {
+	config, err := websocket.NewConfig(ma.websocketURL(), ma.options.URL)
+	if err != nil {
+		return err
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	ma.mu.Lock()
+	ma.seq++
+	seq := ma.seq
+	ma.mu.Unlock()
+	err = websocket.JSON.Send(ws, map[string]interface{}{
+		"seq":    seq,
+		"action": "authentication_challenge",
+		"data":   map[string]string{"token": ma.options.Token},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		var e mattermostEvent
+		if err := websocket.JSON.Receive(ws, &e); err != nil {
+			return err
+		}
+
+		if e.SeqReply == seq && e.Status != "OK" {
+			reason := e.Status
+			if e.Error != nil {
+				reason = e.Error.Message
+			}
+			return fmt.Errorf("Mattermost authentication failed: %s", reason)
+		}
+		switch e.Event {
+		case "hello":
+			ready()
+		case "posted":
+			if m, ok := ma.incoming(e); ok {
+				stdinCh <- m
+			}
+		}
+	}
+}
+
+func (ma *MattermostAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	stdinCh := make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	go func() {
+		backoff := ma.minBackoff
+		for {
+			err := ma.session(stdinCh, func() { backoff = ma.minBackoff })
+			stderrCh <- fmt.Errorf("Disconnected from Mattermost, reconnecting in %s: %v", backoff, err)
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > ma.maxBackoff {
+				backoff = ma.maxBackoff
+			}
+		}
+	}()
+
+	go func() {
+		for m := range stdoutCh {
+			if err := ma.send(m); err != nil {
+				stderrCh <- err
+			}
+		}
+	}()
+
+	return stdinCh, stdoutCh, stderrCh
+}
@@ -0,0 +1,182 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+type mattermostRequest struct {
+	Path string
+	Body map[string]interface{}
+}
+
+// fakeMattermost is a server that authenticates the websockets and gives them
+// to conns, and records the posts and reactions sent to its REST API.
+type fakeMattermost struct {
+	*httptest.Server
+
+	conns    chan *websocket.Conn
+	requests chan mattermostRequest
+}
+
+func newFakeMattermost() *fakeMattermost {
+	fm := &fakeMattermost{
+		conns:    make(chan *websocket.Conn, 10),
+		requests: make(chan mattermostRequest, 10),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v4/websocket", websocket.Handler(func(ws *websocket.Conn) {
+		var challenge struct {
+			Seq    int               `json:"seq"`
+			Action string            `json:"action"`
+			Data   map[string]string `json:"data"`
+		}
+		if err := websocket.JSON.Receive(ws, &challenge); err != nil {
+			return
+		}
+		if challenge.Action != "authentication_challenge" || challenge.Data["token"] != "token" {
+			websocket.JSON.Send(ws, map[string]interface{}{"status": "FAIL", "seq_reply": challenge.Seq, "error": map[string]string{"message": "Invalid or expired session"}})
+			return
+		}
+		websocket.JSON.Send(ws, map[string]interface{}{"status": "OK", "seq_reply": challenge.Seq})
+		websocket.JSON.Send(ws, map[string]interface{}{"event": "hello", "data": map[string]string{}})
+		fm.conns <- ws
+
+		// The connection is open until the client closes it
+		var ignored interface{}
+		for websocket.JSON.Receive(ws, &ignored) == nil {
+		}
+	}))
+	mux.HandleFunc("/api/v4/users/me", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "bot1", "username": "botella"}`))
+	})
+	record := func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		fm.requests <- mattermostRequest{Path: strings.TrimPrefix(r.URL.Path, "/api/v4"), Body: body}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}
+	mux.HandleFunc("/api/v4/posts", record)
+	mux.HandleFunc("/api/v4/reactions", record)
+	fm.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/websocket" && r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"id": "api.context.session_expired.app_error", "message": "Invalid or expired session, please login again."}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return fm
+}
+
+func (fm *fakeMattermost) conn(t *testing.T) *websocket.Conn {
+	select {
+	case ws := <-fm.conns:
+		return ws
+	case <-time.After(5 * time.Second):
+		t.Fatal("the websocket was never connected")
+	}
+	return nil
+}
+
+// posted sends a posted event, the post and the mentions are JSON encoded
+// inside of it as Mattermost does.
+func posted(ws *websocket.Conn, channelType, sender, post string, mentions ...string) {
+	data := map[string]string{"channel_type": channelType, "sender_name": sender, "post": post}
+	if len(mentions) > 0 {
+		encoded, _ := json.Marshal(mentions)
+		data["mentions"] = string(encoded)
+	}
+	websocket.JSON.Send(ws, map[string]interface{}{"event": "posted", "data": data})
+}
+
+func TestMattermost(t *testing.T) {
+	assert := assert.New(t)
+
+	fm := newFakeMattermost()
+	defer fm.Close()
+
+	ma, err := NewMattermost(MattermostOptions{URL: fm.URL + "/", Token: "token"})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("bot1", ma.botID)
+	ma.minBackoff = time.Millisecond
+	stdinCh, stdoutCh, stderrCh := ma.RunAndAttach()
+	// The disconnections are reported as errors
+	go func() {
+		for range stderrCh {
+		}
+	}()
+
+	ws := fm.conn(t)
+	posted(ws, "O", "@alex", `{"id": "p1", "channel_id": "town", "user_id": "u1", "message": "hi @botella"}`, "bot1")
+	posted(ws, "O", "@botella", `{"id": "p2", "channel_id": "town", "user_id": "bot1", "message": "my own reply"}`)
+	posted(ws, "O", "@alex", `{"id": "p3", "channel_id": "town", "user_id": "u1", "message": "alex joined the channel.", "type": "system_join_channel"}`)
+	posted(ws, "P", "@alex", `{"id": "p4", "channel_id": "secret", "user_id": "u1", "root_id": "p0", "message": "in a thread"}`)
+	posted(ws, "D", "@alex", `{"id": "p5", "channel_id": "dm", "user_id": "u1", "message": "ping"}`)
+	posted(ws, "G", "@otherbot", `{"id": "p6", "channel_id": "group", "user_id": "u2", "message": "beep", "props": {"from_bot": "true"}}`)
+
+	assert.Equal(Message{Emitter: "alex", Receiver: "town", Body: "hi @botella", ID: "p1", IsChannel: true, Mentioned: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "alex", Receiver: "secret", Body: "in a thread", ID: "p4", Thread: "p0", IsChannel: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "alex", Receiver: "dm", Body: "ping", ID: "p5", IsDirectMessage: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "otherbot", Receiver: "group", Body: "beep", ID: "p6", IsDirectMessage: true, FromBot: true}, <-stdinCh)
+
+	stdoutCh <- Message{Receiver: "secret", Thread: "p0", Body: "pong"}
+	assert.Equal(mattermostRequest{
+		Path: "/posts",
+		Body: map[string]interface{}{"channel_id": "secret", "message": "pong", "root_id": "p0"},
+	}, <-fm.requests)
+
+	stdoutCh <- Message{Receiver: "dm", Body: "a < b", Format: plugin.FormatCode}
+	assert.Equal(mattermostRequest{
+		Path: "/posts",
+		Body: map[string]interface{}{"channel_id": "dm", "message": "```\na < b\n```"},
+	}, <-fm.requests)
+
+	stdoutCh <- Message{Receiver: "dm", ID: "p5", Reaction: ":thumbsup:"}
+	assert.Equal(mattermostRequest{
+		Path: "/reactions",
+		Body: map[string]interface{}{"user_id": "bot1", "post_id": "p5", "emoji_name": "thumbsup"},
+	}, <-fm.requests)
+
+	// After a disconnection it connects and authenticates again
+	ws.Close()
+	ws = fm.conn(t)
+	posted(ws, "D", "@alex", `{"id": "p7", "channel_id": "dm", "user_id": "u1", "message": "still there?"}`)
+	assert.Equal("still there?", (<-stdinCh).Body)
+}
+
+func TestMattermostInvalidToken(t *testing.T) {
+	fm := newFakeMattermost()
+	defer fm.Close()
+
+	_, err := NewMattermost(MattermostOptions{URL: fm.URL, Token: "wrong"})
+	assert.EqualError(t, err, "Mattermost error (401): Invalid or expired session, please login again.")
+}
+
+func TestMattermostShouldRun(t *testing.T) {
+	assert := assert.New(t)
+
+	ma := &MattermostAdapter{}
+	channel := &Message{Body: "hi", IsChannel: true}
+	dm := &Message{Body: "hi", IsDirectMessage: true}
+
+	assert.True(ma.ShouldRun(&plugin.Plugin{}, channel))
+	assert.True(ma.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, channel))
+	assert.False(ma.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, dm))
+	assert.True(ma.ShouldRun(&plugin.Plugin{RunOnlyOnDirectMessages: true}, dm))
+	assert.False(ma.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, channel))
+	assert.True(ma.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, &Message{Body: "hi", IsChannel: true, Mentioned: true}))
+}
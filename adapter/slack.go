@@ -7,8 +7,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"golang.org/x/net/websocket"
 
 	"github.com/agonzalezro/botella/plugin"
@@ -16,21 +20,50 @@ import (
 )
 
 const (
-	rtmURLformatter = "https://slack.com/api/rtm.start?token=%s"
-	wsURL           = "https://api.slack.com/"
+	wsURL  = "https://api.slack.com/"
+	apiURL = "https://slack.com/api/"
 )
 
+const (
+	// defaultPingInterval is how often a ping is sent to Slack, if nothing
+	// (not even the pong) is received in two intervals the socket is dead.
+	defaultPingInterval = 30 * time.Second
+
+	// defaultMinBackoff and defaultMaxBackoff limit the time waited between
+	// reconnections.
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+var errDisconnected = errors.New("disconnected from Slack")
+
 type SlackAdapter struct {
-	ws *websocket.Conn
+	key    string
+	client *http.Client
+	// api is the URL of the Slack Web API
+	api string
 
 	botID string
+
+	mu sync.Mutex
+	ws *websocket.Conn
+	// connected is closed while there is a websocket connected
+	connected chan struct{}
+	pingID    int
+
+	pingInterval           time.Duration
+	minBackoff, maxBackoff time.Duration
 }
 
 type SlackMessage struct {
-	Type    string `json:"type"`
-	User    string `json:"user"`
-	Channel string `json:"channel"`
-	Text    string `json:"text"`
+	Type     string `json:"type"`
+	User     string `json:"user"`
+	Channel  string `json:"channel"`
+	Text     string `json:"text"`
+	Ts       string `json:"ts,omitempty"`
+	ThreadTs string `json:"thread_ts,omitempty"`
+	Subtype  string `json:"subtype,omitempty"`
+	BotID    string `json:"bot_id,omitempty"`
 }
 
 func (sm SlackMessage) isChannel() bool {
@@ -44,35 +77,65 @@ func (sm SlackMessage) isDirectMessage() bool {
 	return strings.HasPrefix(sm.Channel, "D")
 }
 
-// TODO: this requires refactoring, it's tooooo long
-func NewSlack(key string) (*SlackAdapter, error) {
-	url := fmt.Sprintf(rtmURLformatter, key)
+func (sm SlackMessage) isFromBot() bool {
+	return sm.BotID != "" || sm.Subtype == "bot_message"
+}
+
+// isUser checks if the receiver is a user instead of a channel, IDs of users
+// start with U or W (for Enterprise Grid).
+func isUser(receiver string) bool {
+	return strings.HasPrefix(receiver, "U") || strings.HasPrefix(receiver, "W")
+}
 
-	cert_pool, err := gocertifi.CACerts()
+// slackText returns the body of the message formatted for Slack.
+func slackText(m Message) string {
+	if m.Format == plugin.FormatCode {
+		return "```\n" + m.Body + "\n```"
+	}
+	// Slack already understands its own flavour of markdown
+	return m.Body
+}
+
+func NewSlack(key string) (*SlackAdapter, error) {
+	certPool, err := gocertifi.CACerts()
 	if err != nil {
 		return nil, err
 	}
 
 	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{RootCAs: cert_pool},
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
 	}
-	client := http.Client{Transport: transport}
+	return newSlack(key, apiURL, &http.Client{Transport: transport})
+}
 
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, err
+func newSlack(key, api string, client *http.Client) (*SlackAdapter, error) {
+	sa := &SlackAdapter{
+		key:          key,
+		client:       client,
+		api:          api,
+		connected:    make(chan struct{}),
+		pingInterval: defaultPingInterval,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Received %d while connecting to Slack (expected 200)\n", resp.StatusCode)
+	if err := sa.connect(); err != nil {
+		return nil, err
 	}
+	return sa, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// connect does the RTM handshake and opens the websocket.
+func (sa *SlackAdapter) connect() error {
+	resp, err := sa.client.Get(sa.api + "rtm.start?token=" + url.QueryEscape(sa.key))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Received %d while connecting to Slack (expected 200)\n", resp.StatusCode)
+	}
 
-	type Payload struct {
+	var p struct {
 		Ok    bool
 		Error string
 		URL   string
@@ -80,29 +143,194 @@ func NewSlack(key string) (*SlackAdapter, error) {
 			ID string
 		}
 	}
-	var p Payload
-	err = json.Unmarshal(body, &p)
-	if err != nil {
-		return nil, err
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return err
 	}
 	if !p.Ok {
-		return nil, errors.New(p.Error)
+		return errors.New(p.Error)
 	}
 
 	c, err := websocket.NewConfig(p.URL, wsURL)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if transport, ok := sa.client.Transport.(*http.Transport); ok {
+		c.TlsConfig = transport.TLSClientConfig
 	}
-	c.TlsConfig = &tls.Config{RootCAs: cert_pool}
 	ws, err := websocket.DialConfig(c)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	sa.ws, sa.botID = ws, p.Self.ID
+	close(sa.connected)
+	return nil
+}
+
+// conn returns the websocket, it's nil while disconnected.
+func (sa *SlackAdapter) conn() *websocket.Conn {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return sa.ws
+}
+
+// self returns the ID of the bot, it could change after reconnecting.
+func (sa *SlackAdapter) self() string {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return sa.botID
+}
+
+// waitConnected returns a channel that is closed once there is a websocket
+// connected.
+func (sa *SlackAdapter) waitConnected() chan struct{} {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return sa.connected
+}
+
+// drop closes the websocket if it's still the current one.
+func (sa *SlackAdapter) drop(ws *websocket.Conn) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if ws == nil || sa.ws != ws {
+		return
+	}
+	ws.Close()
+	sa.ws = nil
+	sa.connected = make(chan struct{})
+}
+
+// reconnect drops the websocket and connects again, waiting a little bit
+// more after every failed attempt.
+func (sa *SlackAdapter) reconnect(ws *websocket.Conn, stderrCh chan error) {
+	sa.drop(ws)
+
+	backoff := sa.minBackoff
+	for {
+		err := sa.connect()
+		if err == nil {
+			log.Info("Reconnected to Slack.")
+			return
+		}
+		stderrCh <- fmt.Errorf("Error reconnecting to Slack, retrying in %s: %v", backoff, err)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > sa.maxBackoff {
+			backoff = sa.maxBackoff
+		}
 	}
+}
+
+// ping sends a ping through the websocket, Slack answers with a pong.
+func (sa *SlackAdapter) ping() {
+	sa.mu.Lock()
+	ws := sa.ws
+	sa.pingID++
+	id := sa.pingID
+	sa.mu.Unlock()
 
-	return &SlackAdapter{ws: ws, botID: p.Self.ID}, nil
+	if ws == nil {
+		return
+	}
+	if err := websocket.JSON.Send(ws, map[string]interface{}{"id": id, "type": "ping"}); err != nil {
+		// The reader is going to notice it and reconnect
+		log.Debugf("Error sending ping to Slack: %v", err)
+	}
+}
+
+// callSlackAPI calls a method of the Slack Web API, the response is decoded
+// on v unless it's nil.
+func callSlackAPI(client *http.Client, api, token, method string, params url.Values, v interface{}) error {
+	req, err := http.NewRequest("POST", api+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var r struct {
+		Ok    bool
+		Error string
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return err
+	}
+	if !r.Ok {
+		return fmt.Errorf("Error calling %s on Slack: %s", method, r.Error)
+	}
+	if v != nil {
+		return json.Unmarshal(body, v)
+	}
+	return nil
+}
+
+// callAPI calls a method of the Slack Web API, needed for the things that
+// can't be done through the RTM websocket.
+func (sa *SlackAdapter) callAPI(method string, params url.Values) error {
+	return callSlackAPI(sa.client, sa.api, sa.key, method, params, nil)
+}
+
+func (sa *SlackAdapter) send(m Message) error {
+	if m.Reaction != "" {
+		return sa.callAPI("reactions.add", url.Values{
+			"channel":   {m.Receiver},
+			"timestamp": {m.ID},
+			"name":      {strings.Trim(m.Reaction, ":")},
+		})
+	}
+
+	// Through the RTM we can't send direct messages to a user that didn't
+	// talk to us first, we need to know the ID of that DM channel.
+	if isUser(m.Receiver) {
+		return sa.callAPI("chat.postMessage", url.Values{
+			"channel":   {m.Receiver},
+			"text":      {slackText(m)},
+			"thread_ts": {m.Thread},
+			"as_user":   {"true"},
+		})
+	}
+
+	ws := sa.conn()
+	if ws == nil {
+		return errDisconnected
+	}
+	if err := websocket.JSON.Send(ws, SlackMessage{
+		Type:     "message",
+		Channel:  m.Receiver,
+		Text:     slackText(m),
+		ThreadTs: m.Thread,
+	}); err != nil {
+		log.Warningf("Error sending message to Slack: %v", err)
+		sa.drop(ws)
+		return errDisconnected
+	}
+	return nil
 }
 
 func (sa *SlackAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	return shouldRunOnSlack(p, m, sa.self())
+}
+
+func (sa *SlackAdapter) incoming(m *SlackMessage) (Message, bool) {
+	return incomingSlackMessage(m, sa.self())
+}
+
+// shouldRunOnSlack checks the permissions of the plugin, botID is the user
+// ID of the bot, used to know if it was mentioned.
+func shouldRunOnSlack(p *plugin.Plugin, m *Message, botID string) bool {
 	if p.RunOnlyOnChannels {
 		return m.IsChannel
 	}
@@ -110,14 +338,36 @@ func (sa *SlackAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
 		return m.IsDirectMessage
 	}
 	if p.RunOnlyOnMentions {
-		return strings.Contains(m.Body, sa.botID)
+		return strings.Contains(m.Body, botID)
 	}
 	return true
 }
 
-func (sa *SlackAdapter) getSlackMessage() (*SlackMessage, error) {
+// incomingSlackMessage converts the Slack message to the message sent to the
+// plugins. The messages posted by the bot itself are dropped, otherwise it
+// would be replying to itself forever.
+func incomingSlackMessage(m *SlackMessage, botID string) (Message, bool) {
+	if m.Type != "message" || m.User == botID {
+		return Message{}, false
+	}
+	return Message{
+		Emitter:         m.User,
+		Receiver:        m.Channel,
+		Body:            m.Text,
+		ID:              m.Ts,
+		Thread:          m.ThreadTs,
+		IsChannel:       m.isChannel(),
+		IsDirectMessage: m.isDirectMessage(),
+		FromBot:         m.isFromBot(),
+	}, true
+}
+
+func (sa *SlackAdapter) getSlackMessage(ws *websocket.Conn) (*SlackMessage, error) {
+	// Slack replies to the pings, if nothing arrives the socket is dead
+	ws.SetReadDeadline(time.Now().Add(2 * sa.pingInterval))
+
 	m := SlackMessage{}
-	err := websocket.JSON.Receive(sa.ws, &m)
+	err := websocket.JSON.Receive(ws, &m)
 	return &m, err
 }
 
@@ -128,33 +378,50 @@ func (sa *SlackAdapter) RunAndAttach() (chan Message, chan Message, chan error)
 
 	go func() {
 		for {
-			m, err := sa.getSlackMessage()
+			ws := sa.conn()
+			if ws == nil {
+				// A failed send dropped the websocket while we weren't
+				// reading from it.
+				sa.reconnect(nil, stderrCh)
+				continue
+			}
+			m, err := sa.getSlackMessage(ws)
 			if err != nil {
 				stderrCh <- err
+				sa.reconnect(ws, stderrCh)
 				continue
 			}
-			if m.Type == "message" {
-				stdinCh <- Message{
-					Emitter:         m.User,
-					Receiver:        m.Channel,
-					Body:            m.Text,
-					IsChannel:       m.isChannel(),
-					IsDirectMessage: m.isDirectMessage(),
-				}
+			if m.Type == "goodbye" {
+				// Slack is going to close the connection
+				sa.reconnect(ws, stderrCh)
+				continue
+			}
+			if message, ok := sa.incoming(m); ok {
+				stdinCh <- message
 			}
 		}
 	}()
 
+	go func() {
+		ticker := time.NewTicker(sa.pingInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sa.ping()
+		}
+	}()
+
 	go func() {
 		for {
 			select {
 			case m := <-stdoutCh:
-				sm := SlackMessage{
-					Type:    "message",
-					Channel: m.Receiver,
-					Text:    m.Body,
+				// The replies sent while disconnected wait for the
+				// reconnection instead of being lost.
+				err := sa.send(m)
+				for err == errDisconnected {
+					<-sa.waitConnected()
+					err = sa.send(m)
 				}
-				if err := websocket.JSON.Send(sa.ws, sm); err != nil {
+				if err != nil {
 					stderrCh <- err
 				}
 			}
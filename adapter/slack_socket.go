@@ -0,0 +1,203 @@
+package adapter
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/websocket"
+
+	"github.com/agonzalezro/botella/plugin"
+	"github.com/certifi/gocertifi"
+)
+
+// SlackSocketAdapter connects to Slack using Socket Mode: the events arrive
+// through a websocket opened with an app-level token (xapp-) and the replies
+// are posted with the Web API using the bot token (xoxb-).
+type SlackSocketAdapter struct {
+	appToken string
+	botToken string
+	client   *http.Client
+	// api is the URL of the Slack Web API
+	api string
+
+	botID string
+
+	// ws is only used by the reader, it's replaced when reconnecting
+	ws *websocket.Conn
+
+	minBackoff, maxBackoff time.Duration
+}
+
+// socketEnvelope wraps every event sent by Slack through the websocket.
+type socketEnvelope struct {
+	EnvelopeID string `json:"envelope_id"`
+	Type       string `json:"type"`
+	Payload    struct {
+		Event SlackMessage `json:"event"`
+	} `json:"payload"`
+}
+
+// NewSlackSocket creates the adapter, api is the URL of the Slack Web API,
+// https://slack.com/api/ if it's empty.
+func NewSlackSocket(appToken, botToken, api string) (*SlackSocketAdapter, error) {
+	certPool, err := gocertifi.CACerts()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+	}
+	return newSlackSocket(appToken, botToken, api, &http.Client{Transport: transport})
+}
+
+func newSlackSocket(appToken, botToken, api string, client *http.Client) (*SlackSocketAdapter, error) {
+	if api == "" {
+		api = apiURL
+	}
+	if !strings.HasSuffix(api, "/") {
+		api += "/"
+	}
+
+	ssa := &SlackSocketAdapter{
+		appToken:   appToken,
+		botToken:   botToken,
+		client:     client,
+		api:        api,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+
+	var auth struct {
+		UserID string `json:"user_id"`
+	}
+	if err := callSlackAPI(client, api, botToken, "auth.test", url.Values{}, &auth); err != nil {
+		return nil, err
+	}
+	ssa.botID = auth.UserID
+
+	if err := ssa.connect(); err != nil {
+		return nil, err
+	}
+	return ssa, nil
+}
+
+// connect asks Slack for the URL of a websocket and opens it.
+func (ssa *SlackSocketAdapter) connect() error {
+	var r struct {
+		URL string
+	}
+	if err := callSlackAPI(ssa.client, ssa.api, ssa.appToken, "apps.connections.open", url.Values{}, &r); err != nil {
+		return err
+	}
+
+	c, err := websocket.NewConfig(r.URL, wsURL)
+	if err != nil {
+		return err
+	}
+	if transport, ok := ssa.client.Transport.(*http.Transport); ok {
+		c.TlsConfig = transport.TLSClientConfig
+	}
+	ws, err := websocket.DialConfig(c)
+	if err != nil {
+		return err
+	}
+	ssa.ws = ws
+	return nil
+}
+
+// reconnect closes the websocket and opens a new one, waiting a little bit
+// more after every failed attempt.
+func (ssa *SlackSocketAdapter) reconnect(stderrCh chan error) {
+	ssa.ws.Close()
+
+	backoff := ssa.minBackoff
+	for {
+		err := ssa.connect()
+		if err == nil {
+			log.Info("Reconnected to Slack.")
+			return
+		}
+		stderrCh <- err
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > ssa.maxBackoff {
+			backoff = ssa.maxBackoff
+		}
+	}
+}
+
+func (ssa *SlackSocketAdapter) send(m Message) error {
+	if m.Reaction != "" {
+		return callSlackAPI(ssa.client, ssa.api, ssa.botToken, "reactions.add", url.Values{
+			"channel":   {m.Receiver},
+			"timestamp": {m.ID},
+			"name":      {strings.Trim(m.Reaction, ":")},
+		}, nil)
+	}
+
+	params := url.Values{
+		"channel": {m.Receiver},
+		"text":    {slackText(m)},
+	}
+	if m.Thread != "" {
+		params.Set("thread_ts", m.Thread)
+	}
+	return callSlackAPI(ssa.client, ssa.api, ssa.botToken, "chat.postMessage", params, nil)
+}
+
+func (ssa *SlackSocketAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	return shouldRunOnSlack(p, m, ssa.botID)
+}
+
+func (ssa *SlackSocketAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	stdinCh := make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	go func() {
+		for {
+			var e socketEnvelope
+			if err := websocket.JSON.Receive(ssa.ws, &e); err != nil {
+				stderrCh <- err
+				ssa.reconnect(stderrCh)
+				continue
+			}
+
+			// Slack sends the envelope again if it's not acknowledged
+			if e.EnvelopeID != "" {
+				ack := map[string]string{"envelope_id": e.EnvelopeID}
+				if err := websocket.JSON.Send(ssa.ws, ack); err != nil {
+					stderrCh <- err
+				}
+			}
+
+			switch e.Type {
+			case "disconnect":
+				// Slack is going to close this websocket soon
+				ssa.reconnect(stderrCh)
+			case "events_api":
+				if m, ok := incomingSlackMessage(&e.Payload.Event, ssa.botID); ok {
+					stdinCh <- m
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case m := <-stdoutCh:
+				if err := ssa.send(m); err != nil {
+					stderrCh <- err
+				}
+			}
+		}
+	}()
+
+	return stdinCh, stdoutCh, stderrCh
+}
@@ -0,0 +1,136 @@
+package adapter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// fakeSlackSocket is a Slack API with Socket Mode, it collects the calls to
+// the Web API and gives access to the websockets opened.
+type fakeSlackSocket struct {
+	*httptest.Server
+
+	conns chan *websocket.Conn
+	calls chan url.Values
+	done  chan struct{}
+}
+
+func newFakeSlackSocket() *fakeSlackSocket {
+	f := &fakeSlackSocket{
+		conns: make(chan *websocket.Conn, 10),
+		calls: make(chan url.Values, 10),
+		done:  make(chan struct{}),
+	}
+
+	authorized := func(w http.ResponseWriter, r *http.Request, token string) bool {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			fmt.Fprint(w, `{"ok": false, "error": "invalid_auth"}`)
+			return false
+		}
+		return true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth.test", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r, "xoxb-bot") {
+			fmt.Fprint(w, `{"ok": true, "user_id": "U1PQFQ2SJ"}`)
+		}
+	})
+	mux.HandleFunc("/api/apps.connections.open", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r, "xapp-app") {
+			fmt.Fprintf(w, `{"ok": true, "url": "ws://%s/ws"}`, r.Host)
+		}
+	})
+	mux.HandleFunc("/api/chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r, "xoxb-bot") {
+			r.ParseForm()
+			f.calls <- r.PostForm
+			fmt.Fprint(w, `{"ok": true}`)
+		}
+	})
+	mux.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+		f.conns <- ws
+		// The websocket is used by the test, it's closed when the handler
+		// returns.
+		<-f.done
+	}))
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func TestSlackSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeSlackSocket()
+	defer f.Close()
+	defer close(f.done)
+
+	_, err := newSlackSocket("xapp-app", "xoxb-wrong", f.URL+"/api", http.DefaultClient)
+	assert.Error(err)
+
+	ssa, err := newSlackSocket("xapp-app", "xoxb-bot", f.URL+"/api", http.DefaultClient)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("U1PQFQ2SJ", ssa.botID)
+	ssa.minBackoff, ssa.maxBackoff = 10*time.Millisecond, 50*time.Millisecond
+
+	timeout := time.After(5 * time.Second)
+	var ws *websocket.Conn
+	select {
+	case ws = <-f.conns:
+	case <-timeout:
+		t.Fatal("the adapter never connected")
+	}
+
+	stdinCh, stdoutCh, stderrCh := ssa.RunAndAttach()
+	go func() {
+		for range stderrCh {
+		}
+	}()
+
+	envelope := func(id, user, text string) string {
+		return fmt.Sprintf(`{"envelope_id": "%s", "type": "events_api", "payload": {"event": {"type": "message", "user": "%s", "channel": "C1PP69WMA", "text": "%s", "ts": "1.2"}}}`, id, user, text)
+	}
+	websocket.Message.Send(ws, `{"type": "hello"}`)
+	websocket.Message.Send(ws, envelope("e1", "U1PQFQ2SJ", "pong"))
+	websocket.Message.Send(ws, envelope("e2", "U02SLLLH7", "ping"))
+
+	for _, id := range []string{"e1", "e2"} {
+		var ack map[string]string
+		assert.NoError(websocket.JSON.Receive(ws, &ack))
+		assert.Equal(map[string]string{"envelope_id": id}, ack)
+	}
+
+	select {
+	case m := <-stdinCh:
+		// The message of the bot itself was dropped
+		assert.Equal(Message{Emitter: "U02SLLLH7", Receiver: "C1PP69WMA", Body: "ping", ID: "1.2", IsChannel: true}, m)
+	case <-timeout:
+		t.Fatal("the message never arrived")
+	}
+
+	stdoutCh <- Message{Receiver: "C1PP69WMA", Thread: "1.2", Body: "pong"}
+	select {
+	case params := <-f.calls:
+		assert.Equal("C1PP69WMA", params.Get("channel"))
+		assert.Equal("pong", params.Get("text"))
+		assert.Equal("1.2", params.Get("thread_ts"))
+	case <-timeout:
+		t.Fatal("the reply was never posted")
+	}
+
+	websocket.Message.Send(ws, `{"envelope_id": "e3", "type": "disconnect"}`)
+	select {
+	case <-f.conns:
+	case <-timeout:
+		t.Fatal("the adapter never reconnected")
+	}
+}
@@ -2,9 +2,14 @@ package adapter
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
 
 	"github.com/agonzalezro/botella/plugin"
 )
@@ -33,7 +38,7 @@ func TestChannelOrDirectMessage(t *testing.T) {
 func TestIfPluginShouldBeRun(t *testing.T) {
 	assert := assert.New(t)
 
-	adapter := SlackAdapter{botID: "test-id"}
+	adapter := &SlackAdapter{botID: "test-id"}
 
 	type c struct {
 		runOnlyOnChannels, runOnlyOnDirectMessages, runOnlyOnMentions bool
@@ -68,3 +73,213 @@ func TestIfPluginShouldBeRun(t *testing.T) {
 			fmt.Sprintf("%+v %+v %+v", adapter, p, m))
 	}
 }
+
+func TestSlackText(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("*hi*", slackText(Message{Body: "*hi*"}))
+	assert.Equal("*hi*", slackText(Message{Body: "*hi*", Format: plugin.FormatMarkdown}))
+	assert.Equal("```\nls -l\n```", slackText(Message{Body: "ls -l", Format: plugin.FormatCode}))
+}
+
+func TestIsUser(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isUser("U02SLLLH7"))
+	assert.True(isUser("W02SLLLH7"))
+	assert.False(isUser("C1PP69WMA"))
+	assert.False(isUser("D1PQQAGTZ"))
+}
+
+func TestIncomingMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	sa := &SlackAdapter{botID: "U1PQFQ2SJ"}
+
+	m, ok := sa.incoming(&SlackMessage{Type: "message", User: "U02SLLLH7", Channel: "C1PP69WMA", Text: "ping", Ts: "1.2"})
+	assert.True(ok)
+	assert.Equal(Message{Emitter: "U02SLLLH7", Receiver: "C1PP69WMA", Body: "ping", ID: "1.2", IsChannel: true}, m)
+
+	m, ok = sa.incoming(&SlackMessage{Type: "message", User: "U02SLLLH7", Channel: "C1PP69WMA", Text: "ping", Ts: "1.3", ThreadTs: "1.2"})
+	assert.True(ok)
+	assert.Equal("1.3", m.ID)
+	assert.Equal("1.2", m.Thread)
+
+	_, ok = sa.incoming(&SlackMessage{Type: "message", User: "U1PQFQ2SJ", Channel: "C1PP69WMA", Text: "pong"})
+	assert.False(ok, "messages of the bot itself are dropped")
+
+	_, ok = sa.incoming(&SlackMessage{Type: "presence_change", User: "U02SLLLH7"})
+	assert.False(ok)
+
+	m, ok = sa.incoming(&SlackMessage{Type: "message", BotID: "B01", Channel: "C1PP69WMA", Text: "beep"})
+	assert.True(ok)
+	assert.True(m.FromBot)
+
+	m, ok = sa.incoming(&SlackMessage{Type: "message", Subtype: "bot_message", Channel: "C1PP69WMA", Text: "beep"})
+	assert.True(ok)
+	assert.True(m.FromBot)
+}
+
+// fakeSlack is a Slack RTM API that answers the pings (unless it's muted)
+// and collects the messages received through the websockets.
+type fakeSlack struct {
+	*httptest.Server
+
+	conns    chan *websocket.Conn
+	received chan SlackMessage
+	failures int32 // the next rtm.start calls that fail
+	muted    int32
+}
+
+func newFakeSlack() *fakeSlack {
+	f := &fakeSlack{conns: make(chan *websocket.Conn, 10), received: make(chan SlackMessage, 10)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rtm.start", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&f.failures, -1) >= 0 {
+			fmt.Fprint(w, `{"ok": false, "error": "fatal_error"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"ok": true, "url": "ws://%s/ws", "self": {"id": "U1PQFQ2SJ"}}`, r.Host)
+	})
+	mux.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+		f.conns <- ws
+		for {
+			var m SlackMessage
+			if err := websocket.JSON.Receive(ws, &m); err != nil {
+				return
+			}
+			if m.Type == "ping" {
+				if atomic.LoadInt32(&f.muted) == 0 {
+					websocket.JSON.Send(ws, SlackMessage{Type: "pong"})
+				}
+				continue
+			}
+			f.received <- m
+		}
+	}))
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func TestSlackReconnects(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeSlack()
+	defer f.Close()
+
+	sa, err := newSlack("xoxb-xxx", f.URL+"/", http.DefaultClient)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("U1PQFQ2SJ", sa.self())
+	sa.pingInterval = 50 * time.Millisecond
+	sa.minBackoff, sa.maxBackoff = 10*time.Millisecond, 50*time.Millisecond
+
+	timeout := time.After(5 * time.Second)
+	stdinCh, stdoutCh, stderrCh := sa.RunAndAttach()
+
+	var ws *websocket.Conn
+	select {
+	case ws = <-f.conns:
+	case <-timeout:
+		t.Fatal("the adapter never connected")
+	}
+	websocket.JSON.Send(ws, SlackMessage{Type: "message", User: "U02SLLLH7", Channel: "C1PP69WMA", Text: "ping"})
+	select {
+	case m := <-stdinCh:
+		assert.Equal("ping", m.Body)
+	case <-timeout:
+		t.Fatal("the message never arrived")
+	}
+
+	// The socket is closed and the first reconnection fails, the reply
+	// needs to wait for the next one.
+	atomic.StoreInt32(&f.failures, 1)
+	ws.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stderrCh:
+		case <-timeout:
+			t.Fatal("the disconnection was never noticed")
+		}
+	}
+	go func() {
+		for range stderrCh {
+		}
+	}()
+	stdoutCh <- Message{Receiver: "C1PP69WMA", Body: "pong"}
+
+	select {
+	case <-f.conns:
+	case <-timeout:
+		t.Fatal("the adapter never reconnected")
+	}
+	select {
+	case m := <-f.received:
+		assert.Equal("pong", m.Text)
+	case <-timeout:
+		t.Fatal("the reply was lost")
+	}
+
+	// Without pongs the socket is considered dead
+	atomic.StoreInt32(&f.muted, 1)
+	select {
+	case <-f.conns:
+	case <-timeout:
+		t.Fatal("the dead socket was never noticed")
+	}
+}
+
+func TestSlackReconnectsAfterAFailedSend(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFakeSlack()
+	defer f.Close()
+
+	sa, err := newSlack("xoxb-xxx", f.URL+"/", http.DefaultClient)
+	if !assert.NoError(err) {
+		return
+	}
+	sa.minBackoff, sa.maxBackoff = 10*time.Millisecond, 50*time.Millisecond
+
+	timeout := time.After(5 * time.Second)
+	stdinCh, _, stderrCh := sa.RunAndAttach()
+	go func() {
+		for range stderrCh {
+		}
+	}()
+
+	var ws *websocket.Conn
+	select {
+	case ws = <-f.conns:
+	case <-timeout:
+		t.Fatal("the adapter never connected")
+	}
+
+	// The reader is busy delivering the second message, not reading, when
+	// a send fails and drops the websocket.
+	websocket.JSON.Send(ws, SlackMessage{Type: "message", User: "U02SLLLH7", Channel: "C1PP69WMA", Text: "first"})
+	websocket.JSON.Send(ws, SlackMessage{Type: "message", User: "U02SLLLH7", Channel: "C1PP69WMA", Text: "second"})
+	for len(stdinCh) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	sa.drop(sa.conn())
+
+	assert.Equal("first", (<-stdinCh).Body)
+	assert.Equal("second", (<-stdinCh).Body)
+
+	select {
+	case ws = <-f.conns:
+	case <-timeout:
+		t.Fatal("the adapter never reconnected")
+	}
+	websocket.JSON.Send(ws, SlackMessage{Type: "message", User: "U02SLLLH7", Channel: "C1PP69WMA", Text: "third"})
+	select {
+	case m := <-stdinCh:
+		assert.Equal("third", m.Body)
+	case <-timeout:
+		t.Fatal("the message never arrived")
+	}
+}
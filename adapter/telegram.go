@@ -0,0 +1,412 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+const (
+	telegramAPIURL = "https://api.telegram.org"
+
+	// defaultPollTimeout is how long Telegram holds a getUpdates request
+	// when there is nothing new.
+	defaultPollTimeout = 30 * time.Second
+
+	telegramSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+)
+
+// TelegramOptions are the bot token and how the updates are received: with
+// long polling, or on a webhook if WebhookURL is set.
+type TelegramOptions struct {
+	Token string
+	// APIURL is the URL of the Bot API, https://api.telegram.org by default
+	APIURL string
+
+	// WebhookURL is the public URL where Telegram sends the updates, the
+	// server listens on Bind:Port and on the path of the URL.
+	WebhookURL string
+	Port       int
+	Bind       string
+	// SecretToken, if set, is required on the requests to the webhook
+	SecretToken string
+}
+
+type TelegramAdapter struct {
+	options TelegramOptions
+	client  *http.Client
+	// server receives the updates on the webhook mode, they are sent to
+	// updates.
+	server  *http.Server
+	updates chan Message
+
+	botID    int64
+	username string
+
+	// topics are the topics of the forums seen, by chat and thread. Only
+	// those can be used as message_thread_id, the rest of threads are
+	// message IDs (reply_in_thread: always on a message outside of a topic).
+	mu     sync.Mutex
+	topics map[string]struct{}
+
+	pollTimeout            time.Duration
+	minBackoff, maxBackoff time.Duration
+}
+
+type telegramUser struct {
+	ID       int64  `json:"id"`
+	IsBot    bool   `json:"is_bot"`
+	Username string `json:"username"`
+}
+
+type telegramEntity struct {
+	Type   string        `json:"type"`
+	Offset int           `json:"offset"`
+	Length int           `json:"length"`
+	User   *telegramUser `json:"user,omitempty"`
+}
+
+type telegramMessage struct {
+	MessageID       int64         `json:"message_id"`
+	MessageThreadID int64         `json:"message_thread_id"`
+	IsTopicMessage  bool          `json:"is_topic_message"`
+	From            *telegramUser `json:"from"`
+	Chat            struct {
+		ID   int64  `json:"id"`
+		Type string `json:"type"`
+	} `json:"chat"`
+	Text     string           `json:"text"`
+	Entities []telegramEntity `json:"entities"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// telegramError is an error returned by the Bot API.
+type telegramError struct {
+	Code        int
+	Description string
+}
+
+func (e *telegramError) Error() string {
+	return fmt.Sprintf("Telegram error (%d): %s", e.Code, e.Description)
+}
+
+// entityText returns the text of an entity, its offset and length are in
+// UTF-16 code units.
+func entityText(text string, e telegramEntity) string {
+	units := utf16.Encode([]rune(text))
+	if e.Offset < 0 || e.Length < 0 || e.Offset+e.Length > len(units) {
+		return ""
+	}
+	return string(utf16.Decode(units[e.Offset : e.Offset+e.Length]))
+}
+
+// telegramID returns the ID as a number, which is what the Bot API expects.
+func telegramID(id string) interface{} {
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return n
+	}
+	return id
+}
+
+func NewTelegram(options TelegramOptions) (*TelegramAdapter, error) {
+	if options.APIURL == "" {
+		options.APIURL = telegramAPIURL
+	}
+	options.APIURL = strings.TrimSuffix(options.APIURL, "/")
+
+	ta := &TelegramAdapter{
+		options: options,
+		// The getUpdates requests are held by Telegram for a while
+		client:      &http.Client{Timeout: defaultPollTimeout + 30*time.Second},
+		topics:      make(map[string]struct{}),
+		pollTimeout: defaultPollTimeout,
+		minBackoff:  defaultMinBackoff,
+		maxBackoff:  defaultMaxBackoff,
+	}
+
+	var me telegramUser
+	if err := ta.call("getMe", nil, &me); err != nil {
+		return nil, err
+	}
+	ta.botID, ta.username = me.ID, me.Username
+
+	if options.WebhookURL == "" {
+		// The updates can't be polled while there is a webhook
+		return ta, ta.call("deleteWebhook", nil, nil)
+	}
+
+	u, err := url.Parse(options.WebhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook_url: %v", err)
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, ta.handleUpdate)
+	ta.server = &http.Server{
+		Addr:    net.JoinHostPort(options.Bind, strconv.Itoa(options.Port)),
+		Handler: mux,
+	}
+
+	params := map[string]interface{}{"url": options.WebhookURL, "allowed_updates": []string{"message"}}
+	if options.SecretToken != "" {
+		params["secret_token"] = options.SecretToken
+	}
+	return ta, ta.call("setWebhook", params, nil)
+}
+
+// call calls a method of the Bot API, the result is decoded on out unless
+// it's nil.
+func (ta *TelegramAdapter) call(method string, params interface{}, out interface{}) error {
+	if params == nil {
+		params = struct{}{}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := ta.client.Post(ta.options.APIURL+"/bot"+ta.options.Token+"/"+method, "application/json", bytes.NewReader(body))
+		if err != nil {
+			if urlErr, ok := err.(*url.Error); ok {
+				// The URL has the token, it can't end up in the logs
+				err = urlErr.Err
+			}
+			return fmt.Errorf("Error calling Telegram %s: %v", method, err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		var r struct {
+			OK          bool            `json:"ok"`
+			Result      json.RawMessage `json:"result"`
+			ErrorCode   int             `json:"error_code"`
+			Description string          `json:"description"`
+			Parameters  struct {
+				RetryAfter int `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("Error calling Telegram %s (%d): %v", method, resp.StatusCode, err)
+		}
+		if !r.OK {
+			if r.ErrorCode == http.StatusTooManyRequests && r.Parameters.RetryAfter > 0 {
+				time.Sleep(time.Duration(r.Parameters.RetryAfter) * time.Second)
+				continue
+			}
+			return &telegramError{Code: r.ErrorCode, Description: r.Description}
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(r.Result, out)
+	}
+}
+
+func (ta *TelegramAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	if p.RunOnlyOnChannels {
+		return m.IsChannel
+	}
+	if p.RunOnlyOnDirectMessages {
+		return m.IsDirectMessage
+	}
+	if p.RunOnlyOnMentions {
+		return m.Mentioned
+	}
+	return true
+}
+
+// incoming returns the message for a Telegram one, only the text messages
+// are taken into account.
+func (ta *TelegramAdapter) incoming(tm *telegramMessage) (Message, bool) {
+	if tm == nil || tm.From == nil || tm.Text == "" || tm.From.ID == ta.botID {
+		return Message{}, false
+	}
+
+	body, mentioned := tm.Text, false
+	for _, e := range tm.Entities {
+		switch e.Type {
+		case "mention":
+			mentioned = mentioned || strings.EqualFold(entityText(tm.Text, e), "@"+ta.username)
+		case "text_mention":
+			mentioned = mentioned || (e.User != nil && e.User.ID == ta.botID)
+		case "bot_command":
+			// On groups the commands could be addressed to the bot as
+			// /command@botname, the plugins only need the command.
+			command := entityText(tm.Text, e)
+			if e.Offset == 0 && strings.HasSuffix(strings.ToLower(command), "@"+strings.ToLower(ta.username)) {
+				mentioned = true
+				body = command[:len(command)-len(ta.username)-1] + strings.TrimPrefix(tm.Text, command)
+			}
+		}
+	}
+
+	emitter := tm.From.Username
+	if emitter == "" {
+		emitter = strconv.FormatInt(tm.From.ID, 10)
+	}
+	m := Message{
+		Emitter:         emitter,
+		Receiver:        strconv.FormatInt(tm.Chat.ID, 10),
+		Body:            body,
+		ID:              strconv.FormatInt(tm.MessageID, 10),
+		IsChannel:       tm.Chat.Type == "group" || tm.Chat.Type == "supergroup",
+		IsDirectMessage: tm.Chat.Type == "private",
+		Mentioned:       mentioned,
+		FromBot:         tm.From.IsBot,
+	}
+	if tm.IsTopicMessage {
+		// The topics of the forums are the closest thing to threads
+		m.Thread = strconv.FormatInt(tm.MessageThreadID, 10)
+		ta.mu.Lock()
+		ta.topics[m.Receiver+"/"+m.Thread] = struct{}{}
+		ta.mu.Unlock()
+	}
+	return m, true
+}
+
+// isTopic checks if the thread is a topic of the chat.
+func (ta *TelegramAdapter) isTopic(chat, thread string) bool {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	_, ok := ta.topics[chat+"/"+thread]
+	return ok
+}
+
+func (ta *TelegramAdapter) send(m Message) error {
+	if m.Reaction != "" {
+		return ta.call("setMessageReaction", map[string]interface{}{
+			"chat_id":    telegramID(m.Receiver),
+			"message_id": telegramID(m.ID),
+			"reaction":   []map[string]string{{"type": "emoji", "emoji": m.Reaction}},
+		}, nil)
+	}
+
+	params := map[string]interface{}{"chat_id": telegramID(m.Receiver), "text": m.Body}
+	if m.Format == plugin.FormatCode {
+		params["text"] = "<pre>" + html.EscapeString(m.Body) + "</pre>"
+		params["parse_mode"] = "HTML"
+	}
+	if m.ReplyTo != "" {
+		params["reply_to_message_id"] = telegramID(m.ReplyTo)
+		// The reply is sent even if the message was deleted meanwhile
+		params["allow_sending_without_reply"] = true
+	}
+	if m.Thread != "" && ta.isTopic(m.Receiver, m.Thread) {
+		params["message_thread_id"] = telegramID(m.Thread)
+	}
+	return ta.call("sendMessage", params, nil)
+}
+
+// handleUpdate receives the updates on the webhook mode.
+func (ta *TelegramAdapter) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if secret := ta.options.SecretToken; secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(telegramSecretHeader)), []byte(secret)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var u telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if m, ok := ta.incoming(u.Message); ok {
+		ta.updates <- m
+	}
+}
+
+// poll receives the updates with long polling.
+func (ta *TelegramAdapter) poll(stdinCh chan Message, stderrCh chan error) {
+	var offset int64
+	backoff := ta.minBackoff
+	for {
+		var updates []telegramUpdate
+		err := ta.call("getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(ta.pollTimeout / time.Second),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			stderrCh <- fmt.Errorf("Error getting the updates of Telegram, retrying in %s: %v", backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > ta.maxBackoff {
+				backoff = ta.maxBackoff
+			}
+			continue
+		}
+		backoff = ta.minBackoff
+
+		for _, u := range updates {
+			// The updates are confirmed asking for the next ones
+			offset = u.UpdateID + 1
+			if m, ok := ta.incoming(u.Message); ok {
+				stdinCh <- m
+			}
+		}
+	}
+}
+
+func (ta *TelegramAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	stdinCh := make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	if ta.server == nil {
+		go ta.poll(stdinCh, stderrCh)
+	} else {
+		ta.updates = stdinCh
+		go func() {
+			if err := ta.server.ListenAndServe(); err != http.ErrServerClosed {
+				stderrCh <- err
+			}
+		}()
+	}
+
+	go func() {
+		for m := range stdoutCh {
+			if err := ta.send(m); err != nil {
+				stderrCh <- err
+			}
+		}
+	}()
+
+	return stdinCh, stdoutCh, stderrCh
+}
+
+// Stop stops the server of the webhook, if any.
+func (ta *TelegramAdapter) Stop() error {
+	if ta.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return ta.server.Shutdown(ctx)
+}
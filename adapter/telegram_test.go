@@ -0,0 +1,228 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+type telegramCall struct {
+	Method string
+	Params map[string]interface{}
+}
+
+// fakeTelegram is a Bot API that answers getUpdates with whatever is sent to
+// updates, and records the rest of the calls.
+type fakeTelegram struct {
+	*httptest.Server
+
+	updates chan string
+	calls   chan telegramCall
+}
+
+func newFakeTelegram() *fakeTelegram {
+	ft := &fakeTelegram{
+		updates: make(chan string),
+		calls:   make(chan telegramCall, 100),
+	}
+	ft.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/bot123:secret/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"ok": false, "error_code": 401, "description": "Unauthorized"}`))
+			return
+		}
+		method := strings.TrimPrefix(r.URL.Path, "/bot123:secret/")
+		var params map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&params)
+
+		switch method {
+		case "getMe":
+			w.Write([]byte(`{"ok": true, "result": {"id": 42, "is_bot": true, "username": "botella_bot"}}`))
+			return
+		case "getUpdates":
+			select {
+			case updates := <-ft.updates:
+				ft.calls <- telegramCall{Method: method, Params: params}
+				w.Write([]byte(`{"ok": true, "result": ` + updates + `}`))
+			case <-time.After(20 * time.Millisecond):
+				w.Write([]byte(`{"ok": true, "result": []}`))
+			}
+			return
+		}
+		ft.calls <- telegramCall{Method: method, Params: params}
+		w.Write([]byte(`{"ok": true, "result": true}`))
+	}))
+	return ft
+}
+
+// expect waits for a call to the method, skipping the rest.
+func (ft *fakeTelegram) expect(t *testing.T, method string) map[string]interface{} {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-ft.calls:
+			if c.Method == method {
+				return c.Params
+			}
+		case <-timeout:
+			t.Fatalf("%s was never called", method)
+		}
+	}
+}
+
+func TestEntityText(t *testing.T) {
+	assert := assert.New(t)
+
+	// The emoji takes two UTF-16 code units
+	text := "👋 @botella_bot hi"
+	assert.Equal("@botella_bot", entityText(text, telegramEntity{Offset: 3, Length: 12}))
+	assert.Equal("", entityText(text, telegramEntity{Offset: 10, Length: 20}))
+}
+
+func TestTelegramPolling(t *testing.T) {
+	assert := assert.New(t)
+
+	ft := newFakeTelegram()
+	defer ft.Close()
+
+	ta, err := NewTelegram(TelegramOptions{Token: "123:secret", APIURL: ft.URL + "/"})
+	if !assert.NoError(err) {
+		return
+	}
+	ft.expect(t, "deleteWebhook")
+	assert.Equal("botella_bot", ta.username)
+
+	stdinCh, stdoutCh, _ := ta.RunAndAttach()
+	ft.updates <- `[
+		{"update_id": 10, "message": {"message_id": 1, "from": {"id": 7, "username": "alex"}, "chat": {"id": 7, "type": "private"}, "text": "ping"}},
+		{"update_id": 11, "message": {"message_id": 2, "from": {"id": 7, "username": "alex"}, "chat": {"id": -100, "type": "supergroup"}, "text": "hi @botella_bot",
+			"entities": [{"type": "mention", "offset": 3, "length": 12}]}},
+		{"update_id": 12, "message": {"message_id": 3, "from": {"id": 8}, "chat": {"id": -100, "type": "supergroup"}, "text": "/deploy@botella_bot now",
+			"entities": [{"type": "bot_command", "offset": 0, "length": 19}]}},
+		{"update_id": 13, "message": {"message_id": 4, "from": {"id": 9, "username": "other_bot", "is_bot": true}, "chat": {"id": -100, "type": "supergroup"}, "text": "beep",
+			"is_topic_message": true, "message_thread_id": 99}},
+		{"update_id": 14, "message": {"message_id": 5, "from": {"id": 7, "username": "alex"}, "chat": {"id": -100, "type": "supergroup"}, "sticker": {}}},
+		{"update_id": 15}
+	]`
+
+	assert.Equal(Message{Emitter: "alex", Receiver: "7", Body: "ping", ID: "1", IsDirectMessage: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "alex", Receiver: "-100", Body: "hi @botella_bot", ID: "2", IsChannel: true, Mentioned: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "8", Receiver: "-100", Body: "/deploy now", ID: "3", IsChannel: true, Mentioned: true}, <-stdinCh)
+	assert.Equal(Message{Emitter: "other_bot", Receiver: "-100", Body: "beep", ID: "4", Thread: "99", IsChannel: true, FromBot: true}, <-stdinCh)
+
+	// The updates received are confirmed on the next request
+	assert.Equal(0.0, ft.expect(t, "getUpdates")["offset"])
+	ft.updates <- `[]`
+	assert.Equal(16.0, ft.expect(t, "getUpdates")["offset"])
+
+	stdoutCh <- Message{Receiver: "-100", Body: "pong", ReplyTo: "2"}
+	assert.Equal(map[string]interface{}{
+		"chat_id":                     -100.0,
+		"text":                        "pong",
+		"reply_to_message_id":         2.0,
+		"allow_sending_without_reply": true,
+	}, ft.expect(t, "sendMessage"))
+
+	stdoutCh <- Message{Receiver: "-100", Body: "a < b", Format: plugin.FormatCode, Thread: "99"}
+	assert.Equal(map[string]interface{}{
+		"chat_id":           -100.0,
+		"text":              "<pre>a &lt; b</pre>",
+		"parse_mode":        "HTML",
+		"message_thread_id": 99.0,
+	}, ft.expect(t, "sendMessage"))
+
+	// Outside of the topics there are no threads, the thread started by
+	// reply_in_thread: always on the message 2 is just a reply to it
+	stdoutCh <- Message{Receiver: "-100", Body: "pong", ReplyTo: "2", Thread: "2"}
+	assert.Equal(map[string]interface{}{
+		"chat_id":                     -100.0,
+		"text":                        "pong",
+		"reply_to_message_id":         2.0,
+		"allow_sending_without_reply": true,
+	}, ft.expect(t, "sendMessage"))
+
+	stdoutCh <- Message{Receiver: "7", ID: "1", Reaction: "👍"}
+	assert.Equal(map[string]interface{}{
+		"chat_id":    7.0,
+		"message_id": 1.0,
+		"reaction":   []interface{}{map[string]interface{}{"type": "emoji", "emoji": "👍"}},
+	}, ft.expect(t, "setMessageReaction"))
+}
+
+func TestTelegramWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	ft := newFakeTelegram()
+	defer ft.Close()
+
+	ta, err := NewTelegram(TelegramOptions{
+		Token:       "123:secret",
+		APIURL:      ft.URL,
+		WebhookURL:  "https://bot.example.com/telegram",
+		SecretToken: "s3cr3t",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(map[string]interface{}{
+		"url":             "https://bot.example.com/telegram",
+		"allowed_updates": []interface{}{"message"},
+		"secret_token":    "s3cr3t",
+	}, ft.expect(t, "setWebhook"))
+
+	ta.updates = make(chan Message, 1)
+	srv := httptest.NewServer(ta.server.Handler)
+	defer srv.Close()
+
+	update := `{"update_id": 10, "message": {"message_id": 1, "from": {"id": 7, "username": "alex"}, "chat": {"id": 7, "type": "private"}, "text": "ping"}}`
+	post := func(secret string) int {
+		req, _ := http.NewRequest("POST", srv.URL+"/telegram", strings.NewReader(update))
+		req.Header.Set(telegramSecretHeader, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(http.StatusUnauthorized, post("wrong"))
+	assert.Equal(http.StatusOK, post("s3cr3t"))
+	assert.Equal(Message{Emitter: "alex", Receiver: "7", Body: "ping", ID: "1", IsDirectMessage: true}, <-ta.updates)
+}
+
+func TestTelegramInvalidToken(t *testing.T) {
+	ft := newFakeTelegram()
+	defer ft.Close()
+
+	_, err := NewTelegram(TelegramOptions{Token: "wrong", APIURL: ft.URL})
+	assert.EqualError(t, err, "Telegram error (401): Unauthorized")
+
+	// The token is never part of the errors
+	_, err = NewTelegram(TelegramOptions{Token: "wrong", APIURL: "http://127.0.0.1:1"})
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "wrong")
+	}
+}
+
+func TestTelegramShouldRun(t *testing.T) {
+	assert := assert.New(t)
+
+	ta := &TelegramAdapter{}
+	group := &Message{Body: "hi", IsChannel: true}
+	private := &Message{Body: "hi", IsDirectMessage: true}
+
+	assert.True(ta.ShouldRun(&plugin.Plugin{}, group))
+	assert.True(ta.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, group))
+	assert.False(ta.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, private))
+	assert.True(ta.ShouldRun(&plugin.Plugin{RunOnlyOnDirectMessages: true}, private))
+	assert.False(ta.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, group))
+	assert.True(ta.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, &Message{Body: "hi", IsChannel: true, Mentioned: true}))
+}
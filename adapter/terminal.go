@@ -0,0 +1,196 @@
+package adapter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+// TerminalOptions are where the messages written on the terminal are sent
+// from and to at the beginning, the commands can change them later.
+type TerminalOptions struct {
+	// Name is the name of the bot, `@name` in a message is a mention
+	Name     string
+	Emitter  string
+	Receiver string
+
+	IsChannel       bool
+	IsDirectMessage bool
+	// Mention makes every message a mention to the bot
+	Mention bool
+}
+
+// TerminalAdapter reads the messages from stdin and writes the replies to
+// stdout, it's meant to try the plugins while developing them.
+type TerminalAdapter struct {
+	in  io.Reader
+	out io.Writer
+
+	mu      sync.Mutex
+	options TerminalOptions
+	// outMu serializes the writes, the replies and the commands write
+	// from different goroutines.
+	outMu sync.Mutex
+}
+
+const terminalUsage = `Commands:
+  /as <user>       send the messages as this user
+  /in <channel>    send the messages to this channel
+  /dm              send the messages as direct messages
+  /mention on|off  mention the bot on every message
+  /whoami          show who is sending the messages and where`
+
+func NewTerminal(options TerminalOptions) *TerminalAdapter {
+	return newTerminal(options, os.Stdin, os.Stdout)
+}
+
+func newTerminal(options TerminalOptions, in io.Reader, out io.Writer) *TerminalAdapter {
+	if options.Name == "" {
+		options.Name = "botella"
+	}
+	return &TerminalAdapter{in: in, out: out, options: options}
+}
+
+func (ta *TerminalAdapter) printf(format string, a ...interface{}) {
+	ta.outMu.Lock()
+	defer ta.outMu.Unlock()
+	fmt.Fprintf(ta.out, format, a...)
+}
+
+// mentions checks if the message mentions the bot.
+func (ta *TerminalAdapter) mentions(m *Message) bool {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.options.Mention || strings.Contains(m.Body, "@"+ta.options.Name)
+}
+
+func (ta *TerminalAdapter) ShouldRun(p *plugin.Plugin, m *Message) bool {
+	if p.RunOnlyOnChannels {
+		return m.IsChannel
+	}
+	if p.RunOnlyOnDirectMessages {
+		return m.IsDirectMessage
+	}
+	if p.RunOnlyOnMentions {
+		return ta.mentions(m)
+	}
+	return true
+}
+
+// whoami says who is sending the messages and where, the lock must be held.
+func (ta *TerminalAdapter) whoami() string {
+	where := ta.options.Receiver
+	switch {
+	case ta.options.IsChannel:
+		where = "#" + where
+	case ta.options.IsDirectMessage:
+		where = "a direct message"
+	}
+	mention := ""
+	if ta.options.Mention {
+		mention = ", mentioning the bot"
+	}
+	return fmt.Sprintf("You are %s writing in %s%s.", ta.options.Emitter, where, mention)
+}
+
+// command runs a command of the terminal, it returns what needs to be
+// printed.
+func (ta *TerminalAdapter) command(line string) string {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+	switch {
+	case name == "/as" && len(args) == 1:
+		ta.options.Emitter = args[0]
+	case name == "/in" && len(args) == 1:
+		ta.options.Receiver = strings.TrimPrefix(args[0], "#")
+		ta.options.IsChannel, ta.options.IsDirectMessage = true, false
+	case name == "/dm" && len(args) == 0:
+		ta.options.Receiver = "dm-" + ta.options.Emitter
+		ta.options.IsChannel, ta.options.IsDirectMessage = false, true
+	case name == "/mention" && len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+		ta.options.Mention = args[0] == "on"
+	case name == "/whoami" && len(args) == 0:
+	default:
+		return terminalUsage
+	}
+	return ta.whoami()
+}
+
+func (ta *TerminalAdapter) message(body string) Message {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return Message{
+		Emitter:         ta.options.Emitter,
+		Receiver:        ta.options.Receiver,
+		Body:            body,
+		IsChannel:       ta.options.IsChannel,
+		IsDirectMessage: ta.options.IsDirectMessage,
+	}
+}
+
+// reply prints a reply prefixed with the image of the plugin that sent it.
+func (ta *TerminalAdapter) reply(m Message) {
+	prefix := m.Image
+	if prefix == "" {
+		prefix = ta.options.Name
+	}
+	prefix = "[" + prefix + "]"
+
+	ta.mu.Lock()
+	if m.Receiver != ta.options.Receiver {
+		prefix += " (to " + m.Receiver + ")"
+	}
+	ta.mu.Unlock()
+
+	if m.Reaction != "" {
+		ta.printf("%s reacted with :%s:\n", prefix, m.Reaction)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(m.Body, "\n"), "\n") {
+		ta.printf("%s %s\n", prefix, line)
+	}
+}
+
+func (ta *TerminalAdapter) RunAndAttach() (chan Message, chan Message, chan error) {
+	stdinCh := make(chan Message, 1)
+	stdoutCh := make(chan Message, 1)
+	stderrCh := make(chan error, 1)
+
+	ta.mu.Lock()
+	banner := ta.whoami()
+	ta.mu.Unlock()
+	ta.printf("%s Write /help to see the commands.\n", banner)
+
+	go func() {
+		scanner := bufio.NewScanner(ta.in)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case line == "":
+			case strings.HasPrefix(line, "/"):
+				ta.printf("%s\n", ta.command(line))
+			default:
+				stdinCh <- ta.message(line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			stderrCh <- err
+		}
+	}()
+
+	go func() {
+		for m := range stdoutCh {
+			ta.reply(m)
+		}
+	}()
+
+	return stdinCh, stdoutCh, stderrCh
+}
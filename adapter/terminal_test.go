@@ -0,0 +1,112 @@
+package adapter
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/agonzalezro/botella/plugin"
+)
+
+// syncBuffer is a buffer that can be written and read from different
+// goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForOutput(t *testing.T, out *syncBuffer, s string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q was never written, the output is:\n%s", s, out.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	assert := assert.New(t)
+
+	in, w := io.Pipe()
+	defer w.Close()
+	out := &syncBuffer{}
+	ta := newTerminal(TerminalOptions{Emitter: "alex", Receiver: "general", IsChannel: true}, in, out)
+	stdinCh, stdoutCh, _ := ta.RunAndAttach()
+	waitForOutput(t, out, "You are alex writing in #general.")
+
+	io.WriteString(w, "ping\n")
+	assert.Equal(Message{Emitter: "alex", Receiver: "general", Body: "ping", IsChannel: true}, <-stdinCh)
+
+	io.WriteString(w, "/as bob\n")
+	waitForOutput(t, out, "You are bob writing in #general.")
+	io.WriteString(w, "/in #random\n")
+	waitForOutput(t, out, "You are bob writing in #random.")
+	io.WriteString(w, "hi\n")
+	assert.Equal(Message{Emitter: "bob", Receiver: "random", Body: "hi", IsChannel: true}, <-stdinCh)
+
+	io.WriteString(w, "/dm\n")
+	waitForOutput(t, out, "You are bob writing in a direct message.")
+	io.WriteString(w, "secret\n")
+	assert.Equal(Message{Emitter: "bob", Receiver: "dm-bob", Body: "secret", IsDirectMessage: true}, <-stdinCh)
+
+	io.WriteString(w, "/what\n")
+	waitForOutput(t, out, "/as <user>")
+
+	stdoutCh <- Message{Receiver: "dm-bob", Body: "pong\nand more", Image: "agonzalezro/botella-test"}
+	stdoutCh <- Message{Receiver: "dm-bob", Reaction: "+1", Image: "agonzalezro/botella-test"}
+	stdoutCh <- Message{Receiver: "general", Body: "elsewhere"}
+	waitForOutput(t, out, "[botella] (to general) elsewhere\n")
+	assert.Contains(out.String(), "[agonzalezro/botella-test] pong\n[agonzalezro/botella-test] and more\n")
+	assert.Contains(out.String(), "[agonzalezro/botella-test] reacted with :+1:\n")
+}
+
+func TestTerminalShouldRun(t *testing.T) {
+	assert := assert.New(t)
+
+	ta := newTerminal(TerminalOptions{}, nil, nil)
+	channel := &Message{Body: "hi", IsChannel: true}
+	dm := &Message{Body: "hi", IsDirectMessage: true}
+	mention := &Message{Body: "hi @botella", IsChannel: true}
+
+	assert.True(ta.ShouldRun(&plugin.Plugin{}, channel))
+	assert.True(ta.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, channel))
+	assert.False(ta.ShouldRun(&plugin.Plugin{RunOnlyOnChannels: true}, dm))
+	assert.True(ta.ShouldRun(&plugin.Plugin{RunOnlyOnDirectMessages: true}, dm))
+	assert.False(ta.ShouldRun(&plugin.Plugin{RunOnlyOnDirectMessages: true}, channel))
+	assert.True(ta.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, mention))
+	assert.False(ta.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, channel))
+
+	ta.command("/mention on")
+	assert.True(ta.ShouldRun(&plugin.Plugin{RunOnlyOnMentions: true}, channel))
+}
+
+func TestNewTerminalFromEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := New("terminal", map[string]string{"emitter": "alex", "direct_message": "true"})
+	if assert.NoError(err) {
+		ta := a.(*TerminalAdapter)
+		assert.Equal(TerminalOptions{Name: "botella", Emitter: "alex", Receiver: "general", IsDirectMessage: true}, ta.options)
+	}
+
+	_, err = New("terminal", map[string]string{"mention": "maybe"})
+	assert.Error(err)
+}
@@ -16,13 +16,71 @@ type Adapter struct {
 	Environment map[string]string
 }
 
+// Triggers are the messages that trigger a plugin: commands (with an optional
+// prefix) or regular expressions.
+type Triggers struct {
+	Prefix   string
+	Commands []string
+	Regexes  []string
+}
+
 type Plugin struct {
-	Image              string
+	// Name, Description and Usage override the ones defined on the labels
+	// of the image, they are used by the built-in help.
+	Name        string
+	Description string
+	Usage       string
+
+	// Runtime is where the plugin is run: docker (default) or exec
+	Runtime string
+	Image   string
+	// PullPolicy is one of always (default), if-not-present or never
+	PullPolicy string `yaml:"pull_policy"`
+	// Auth are the credentials of the registry where the image is
+	Auth map[string]string
+	// Command is the local binary or script run by the exec runtime
+	Command string
+	// Mode is how the plugin process is run: oneshot (default) starts it
+	// for every message, persistent keeps it running between messages
+	Mode string
+
+	// MaxConcurrency is the number of messages that the plugin can handle
+	// at the same time (1 by default), MinIdle the number of containers
+	// created in advance waiting for messages.
+	MaxConcurrency int `yaml:"max_concurrency"`
+	MinIdle        int `yaml:"min_idle"`
+
+	// Timeout is the maximum time that the plugin can take to reply, in
+	// the format of Go durations: 30s, 1m...
+	Timeout string
+	// TimeoutMessage is the reply sent when the plugin times out
+	TimeoutMessage string `yaml:"timeout_message"`
+
+	// Memory is the memory limit of the container: 512k, 256m, 1g...
+	Memory    string
+	CPUShares int64 `yaml:"cpu_shares"`
+	CPUQuota  int64 `yaml:"cpu_quota"`
+	PidsLimit int64 `yaml:"pids_limit"`
+
+	ReadOnly        bool     `yaml:"read_only"`
+	CapDrop         []string `yaml:"cap_drop"`
+	NoNewPrivileges bool     `yaml:"no_new_privileges"`
+	User            string
+	// Tmpfs is a list of paths in the form `path[:options]`
+	Tmpfs       []string
+	NetworkMode string `yaml:"network_mode"`
+
 	Environment        map[string]string
 	Volumes            []string
 	OnlyChannels       bool `yaml:"only_channels"`
 	OnlyDirectMessages bool `yaml:"only_direct_messages"`
 	OnlyMentions       bool `yaml:"only_mentions"`
+	// ReplyInThread is one of always, if-threaded (default) or never
+	ReplyInThread string `yaml:"reply_in_thread"`
+	// RespondToBots allows the plugin to reply to messages of other bots
+	RespondToBots bool `yaml:"respond_to_bots"`
+
+	Triggers Triggers
 }
 
 func NewFromFile(filePath string) (*Config, error) {
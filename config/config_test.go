@@ -28,8 +28,37 @@ plugins:
     only_channels: true
 `
 
-func setup(assert *assert.Assertions) *os.File {
-	content := []byte(validYAML)
+const execYAML = `
+plugins:
+  - runtime: exec
+    command: ./scripts/ping.sh
+    triggers:
+      prefix: "!"
+      commands:
+        - ping
+      regexes:
+        - ^pong$
+`
+
+const hardenedYAML = `
+plugins:
+  - image: third-party/plugin
+    memory: 256m
+    cpu_shares: 512
+    cpu_quota: 50000
+    pids_limit: 64
+    read_only: true
+    cap_drop:
+      - ALL
+    no_new_privileges: true
+    user: nobody
+    tmpfs:
+      - /tmp
+    network_mode: none
+`
+
+func setup(assert *assert.Assertions, yaml string) *os.File {
+	content := []byte(yaml)
 	tmpfile, err := ioutil.TempFile("", "validYAML")
 	assert.NoError(err)
 
@@ -42,7 +71,7 @@ func setup(assert *assert.Assertions) *os.File {
 
 func TestNewFromFile(t *testing.T) {
 	assert := assert.New(t)
-	tmpfile := setup(assert)
+	tmpfile := setup(assert, validYAML)
 
 	config, err := NewFromFile(tmpfile.Name())
 	assert.NoError(err)
@@ -68,3 +97,40 @@ func TestNewFromFile(t *testing.T) {
 	assert.Equal(true, plugin.OnlyMentions)
 	assert.Equal(true, plugin.OnlyChannels)
 }
+
+func TestNewFromFileWithExecRuntime(t *testing.T) {
+	assert := assert.New(t)
+	tmpfile := setup(assert, execYAML)
+
+	config, err := NewFromFile(tmpfile.Name())
+	assert.NoError(err)
+
+	assert.Equal(len(config.Plugins), 1)
+	plugin := config.Plugins[0]
+	assert.Equal("exec", plugin.Runtime)
+	assert.Equal("./scripts/ping.sh", plugin.Command)
+	assert.Equal("", plugin.Image)
+	assert.Equal("!", plugin.Triggers.Prefix)
+	assert.Equal([]string{"ping"}, plugin.Triggers.Commands)
+	assert.Equal([]string{"^pong$"}, plugin.Triggers.Regexes)
+}
+
+func TestNewFromFileWithHardening(t *testing.T) {
+	assert := assert.New(t)
+	tmpfile := setup(assert, hardenedYAML)
+
+	config, err := NewFromFile(tmpfile.Name())
+	assert.NoError(err)
+
+	plugin := config.Plugins[0]
+	assert.Equal("256m", plugin.Memory)
+	assert.Equal(int64(512), plugin.CPUShares)
+	assert.Equal(int64(50000), plugin.CPUQuota)
+	assert.Equal(int64(64), plugin.PidsLimit)
+	assert.True(plugin.ReadOnly)
+	assert.Equal([]string{"ALL"}, plugin.CapDrop)
+	assert.True(plugin.NoNewPrivileges)
+	assert.Equal("nobody", plugin.User)
+	assert.Equal([]string{"/tmp"}, plugin.Tmpfs)
+	assert.Equal("none", plugin.NetworkMode)
+}
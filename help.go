@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/agonzalezro/botella/adapter"
+	"github.com/agonzalezro/botella/plugin"
+)
+
+// helpTriggers are the messages answered by the built-in help: `help` and
+// `help <plugin>`. Anything else after `help` is left for the plugins.
+var helpTriggers, _ = plugin.NewTriggers("", []string{"help"}, nil)
+
+// isVisible checks if the plugin can be run where the message was sent,
+// the mentions are not taken into account because the help itself could be
+// asked without mentioning the bot.
+func isVisible(a adapter.Adapter, p *plugin.Plugin, m *adapter.Message) bool {
+	withoutMentions := *p
+	withoutMentions.RunOnlyOnMentions = false
+	return a.ShouldRun(&withoutMentions, m)
+}
+
+// help returns the reply of the built-in help if the message is asking for
+// it: `help` alone or followed by the name of a plugin. Only the plugins
+// visible where the message was sent are listed.
+func help(a adapter.Adapter, plugins []*plugin.Plugin, m adapter.Message) (adapter.Message, bool) {
+	matches, ok := helpTriggers.Match(m.Body)
+	if !ok {
+		return adapter.Message{}, false
+	}
+
+	var visible []*plugin.Plugin
+	for _, p := range plugins {
+		if isVisible(a, p, &m) {
+			visible = append(visible, p)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool { return visible[i].Name < visible[j].Name })
+
+	reply := adapter.Message{Receiver: m.Receiver, Thread: m.Thread, Format: plugin.FormatMarkdown, ReplyTo: m.ID}
+	if name := matches["args"]; name != "" {
+		// "help me with prod" is not for us
+		if !isPluginName(plugins, name) {
+			return adapter.Message{}, false
+		}
+		reply.Body = fmt.Sprintf("I don't know any plugin called %s.", name)
+		for _, p := range visible {
+			if strings.EqualFold(p.Name, name) {
+				reply.Body = pluginHelp(p)
+				break
+			}
+		}
+		return reply, true
+	}
+
+	if len(visible) == 0 {
+		reply.Body = "There are no plugins available here."
+		return reply, true
+	}
+
+	lines := []string{"These are the plugins available here:"}
+	for _, p := range visible {
+		line := fmt.Sprintf("- *%s*", p.Name)
+		if p.Description != "" {
+			line += ": " + p.Description
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "Write `help <plugin>` to know how to use any of them.")
+	reply.Body = strings.Join(lines, "\n")
+	return reply, true
+}
+
+// isPluginName checks if any of the plugins is called name.
+func isPluginName(plugins []*plugin.Plugin, name string) bool {
+	for _, p := range plugins {
+		if strings.EqualFold(p.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginHelp is the help of a single plugin: its description and its usage.
+func pluginHelp(p *plugin.Plugin) string {
+	lines := []string{fmt.Sprintf("*%s*", p.Name)}
+	if p.Description != "" {
+		lines = append(lines, p.Description)
+	}
+	if p.Usage != "" {
+		lines = append(lines, fmt.Sprintf("Usage: `%s`", p.Usage))
+	}
+	if len(lines) == 1 {
+		lines = append(lines, "This plugin doesn't have any help.")
+	}
+	return strings.Join(lines, "\n")
+}
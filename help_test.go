@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/agonzalezro/botella/adapter"
+	"github.com/agonzalezro/botella/plugin"
+)
+
+func TestHelp(t *testing.T) {
+	assert := assert.New(t)
+
+	plugins := []*plugin.Plugin{
+		{Name: "echo", Description: "Echoes whatever you say", RunOnlyOnMentions: true},
+		{Name: "deployer", Description: "Deploys our apps", Usage: "!deploy <app>", RunOnlyOnChannels: true},
+		{Name: "secrets", RunOnlyOnDirectMessages: true},
+	}
+	slack := &adapter.SlackAdapter{}
+
+	_, ok := help(slack, plugins, adapter.Message{Body: "I need help"})
+	assert.False(ok)
+
+	reply, ok := help(slack, plugins, adapter.Message{Receiver: "C1", Body: "<@U1PQFQ2SJ> help", IsChannel: true})
+	assert.True(ok)
+	assert.Equal("C1", reply.Receiver)
+	assert.Equal(plugin.FormatMarkdown, reply.Format)
+	assert.Contains(reply.Body, "*deployer*: Deploys our apps")
+	assert.Contains(reply.Body, "*echo*: Echoes whatever you say")
+	assert.NotContains(reply.Body, "secrets")
+
+	reply, ok = help(slack, plugins, adapter.Message{Body: "help", IsDirectMessage: true})
+	assert.True(ok)
+	assert.Contains(reply.Body, "secrets")
+	assert.NotContains(reply.Body, "deployer")
+
+	reply, ok = help(slack, plugins, adapter.Message{Body: "help Deployer", IsChannel: true})
+	assert.True(ok)
+	assert.Equal("*deployer*\nDeploys our apps\nUsage: `!deploy <app>`", reply.Body)
+
+	reply, ok = help(slack, plugins, adapter.Message{Body: "help deployer", IsDirectMessage: true})
+	assert.True(ok)
+	assert.Equal("I don't know any plugin called deployer.", reply.Body)
+
+	// The rest of messages starting with help are for the plugins
+	_, ok = help(slack, plugins, adapter.Message{Body: "help me with prod", IsChannel: true})
+	assert.False(ok)
+
+	reply, ok = help(slack, nil, adapter.Message{Body: "help"})
+	assert.True(ok)
+	assert.Equal("There are no plugins available here.", reply.Body)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/agonzalezro/botella/adapter"
+)
+
+const (
+	// loopWindow is how long the replies are remembered by the loop guard.
+	loopWindow = 30 * time.Second
+	// loopLimit is how many replies can be sent to a receiver inside of the
+	// window before the messages of other bots are dropped there.
+	loopLimit = 10
+)
+
+// loopGuard counts the replies sent to every receiver since the last message
+// of a person there. The adapters already drop the messages of the bot itself,
+// but a plugin with respond_to_bots could keep talking with another bot
+// forever: once the limit is reached the messages of the bots are dropped
+// until a person writes again or the window is over.
+type loopGuard struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	sent map[string][]time.Time
+}
+
+func newLoopGuard() *loopGuard {
+	return &loopGuard{now: time.Now, sent: make(map[string][]time.Time)}
+}
+
+// recent returns the replies sent to the receiver inside of the window,
+// forgetting the older ones. The lock must be held.
+func (lg *loopGuard) recent(receiver string) []time.Time {
+	now := lg.now()
+	sent := lg.sent[receiver]
+	for len(sent) > 0 && now.Sub(sent[0]) > loopWindow {
+		sent = sent[1:]
+	}
+	if len(sent) == 0 {
+		delete(lg.sent, receiver)
+		return nil
+	}
+	lg.sent[receiver] = sent
+	return sent
+}
+
+// record counts a reply sent to the adapter.
+func (lg *loopGuard) record(m adapter.Message) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.sent[m.Receiver] = append(lg.recent(m.Receiver), lg.now())
+}
+
+// allow checks if the message can be dispatched. The messages of people are
+// always allowed and start the count again.
+func (lg *loopGuard) allow(m adapter.Message) bool {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	if !m.FromBot {
+		delete(lg.sent, m.Receiver)
+		return true
+	}
+	return len(lg.recent(m.Receiver)) < loopLimit
+}
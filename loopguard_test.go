@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/agonzalezro/botella/adapter"
+	"github.com/agonzalezro/botella/config"
+)
+
+func TestLoopGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	guard := newLoopGuard()
+	guard.now = func() time.Time { return now }
+
+	bot := adapter.Message{Receiver: "C1", Body: "beep", FromBot: true}
+	for i := 0; i < loopLimit; i++ {
+		assert.True(guard.allow(bot))
+		guard.record(adapter.Message{Receiver: "C1", Body: "boop"})
+	}
+	assert.False(guard.allow(bot))
+	assert.True(guard.allow(adapter.Message{Receiver: "C2", Body: "beep", FromBot: true}))
+
+	// Once the window is over the bot can talk again
+	now = now.Add(loopWindow + time.Second)
+	assert.True(guard.allow(bot))
+
+	for i := 0; i < loopLimit; i++ {
+		guard.record(adapter.Message{Receiver: "C1", Body: "boop"})
+	}
+	assert.False(guard.allow(bot))
+	// A person writing starts the count again
+	assert.True(guard.allow(adapter.Message{Receiver: "C1", Body: "stop it"}))
+	assert.True(guard.allow(bot))
+}
+
+func TestDispatchLoopGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	plugins, err := loadPlugins(&config.Config{
+		Plugins: []config.Plugin{{Runtime: "exec", Command: "echo hi", RespondToBots: true}},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	for _, p := range plugins {
+		defer p.Stop()
+	}
+
+	ra := reportingAdapter{results: make(chan adapter.Result, 1), done: make(chan adapter.Message, 1)}
+	guard := newLoopGuard()
+	replies := make(chan adapter.Message, 1)
+	reply := func(m adapter.Message) {
+		guard.record(m)
+		replies <- m
+	}
+
+	run := func(m adapter.Message) bool {
+		dispatch(ra, plugins, guard, m, reply, make(chan error, 1))
+		<-ra.done
+		select {
+		case <-ra.results:
+			<-replies
+			return true
+		default:
+			return false
+		}
+	}
+
+	// The plugin and another bot keep replying to each other
+	hi := adapter.Message{Receiver: "C1", Body: "hi"}
+	bot := adapter.Message{Receiver: "C1", Body: "hi", FromBot: true}
+	assert.True(run(hi))
+	for i := 0; i < loopLimit-1; i++ {
+		assert.True(run(bot))
+	}
+	assert.False(run(bot), "the plugin was run for the bot")
+
+	// A person saying the same is never dropped
+	assert.True(run(hi))
+	assert.True(run(hi))
+}
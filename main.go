@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/agonzalezro/botella/adapter"
@@ -45,25 +47,202 @@ func ensureVolumeHasMountPoint(vs []string) []string {
 	return volumes
 }
 
+// parseMemory returns the number of bytes of a memory limit in the form
+// `<number>[<unit>]`, where the unit is one of b, k, m or g.
+func parseMemory(memory string) (int64, error) {
+	if memory == "" {
+		return 0, nil
+	}
+
+	units := map[string]int64{"b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+	s := strings.ToLower(memory)
+	multiplier := int64(1)
+	if unit, ok := units[s[len(s)-1:]]; ok {
+		multiplier = unit
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory limit: %s", memory)
+	}
+	return n * multiplier, nil
+}
+
+// tmpfsAsMap converts the list of tmpfs in the form `path[:options]` to the
+// map of path & options expected by Docker.
+func tmpfsAsMap(ts []string) map[string]string {
+	tmpfs := make(map[string]string)
+	for _, t := range ts {
+		fragments := strings.SplitN(t, ":", 2)
+		if len(fragments) < 2 {
+			fragments = append(fragments, "")
+		}
+		tmpfs[fragments[0]] = fragments[1]
+	}
+	return tmpfs
+}
+
+// newRuntime returns the runtime where the plugin is going to be run, the
+// name that identifies the plugin and the metadata from the labels of its
+// image, if any.
+func newRuntime(pluginConfig config.Plugin) (plugin.Runtime, string, plugin.Metadata, error) {
+	var persistent bool
+	switch pluginConfig.Mode {
+	case "", "oneshot":
+	case "persistent":
+		persistent = true
+	default:
+		return nil, "", plugin.Metadata{}, fmt.Errorf("Mode '%s' not found", pluginConfig.Mode)
+	}
+
+	var (
+		runtime  plugin.Runtime
+		name     string
+		metadata plugin.Metadata
+	)
+	switch pluginConfig.Runtime {
+	case "", "docker":
+		memory, err := parseMemory(pluginConfig.Memory)
+		if err != nil {
+			return nil, "", plugin.Metadata{}, err
+		}
+		dockerRuntime, err := plugin.NewDockerRuntime(plugin.DockerOptions{
+			Image:           pluginConfig.Image,
+			Environment:     pluginConfig.Environment,
+			Volumes:         ensureVolumeHasMountPoint(pluginConfig.Volumes),
+			Persistent:      persistent,
+			PullPolicy:      pluginConfig.PullPolicy,
+			Auth:            pluginConfig.Auth,
+			Memory:          memory,
+			CPUShares:       pluginConfig.CPUShares,
+			CPUQuota:        pluginConfig.CPUQuota,
+			PidsLimit:       pluginConfig.PidsLimit,
+			ReadOnly:        pluginConfig.ReadOnly,
+			CapDrop:         pluginConfig.CapDrop,
+			NoNewPrivileges: pluginConfig.NoNewPrivileges,
+			User:            pluginConfig.User,
+			Tmpfs:           tmpfsAsMap(pluginConfig.Tmpfs),
+			NetworkMode:     pluginConfig.NetworkMode,
+		})
+		if err != nil {
+			return nil, "", plugin.Metadata{}, err
+		}
+		runtime, name, metadata = dockerRuntime, pluginConfig.Image, dockerRuntime.Metadata()
+	case "exec":
+		execRuntime, err := plugin.NewExecRuntime(plugin.ExecOptions{
+			Command:     pluginConfig.Command,
+			Environment: pluginConfig.Environment,
+		})
+		if err != nil {
+			return nil, "", plugin.Metadata{}, err
+		}
+		runtime, name = execRuntime, pluginConfig.Command
+	default:
+		return nil, "", plugin.Metadata{}, fmt.Errorf("Runtime '%s' not found", pluginConfig.Runtime)
+	}
+
+	if persistent {
+		persistentRuntime, err := plugin.NewPersistentRuntime(runtime)
+		if err != nil {
+			runtime.Stop()
+			return nil, "", plugin.Metadata{}, err
+		}
+		runtime = persistentRuntime
+	}
+
+	poolRuntime, err := plugin.NewPoolRuntime(runtime, plugin.PoolOptions{
+		MaxConcurrency: pluginConfig.MaxConcurrency,
+		MinIdle:        pluginConfig.MinIdle,
+	})
+	if err != nil {
+		runtime.Stop()
+		return nil, "", plugin.Metadata{}, err
+	}
+	return poolRuntime, name, metadata, nil
+}
+
+// withMetadata returns the plugin config using the metadata as the default
+// values of the fields that are not set.
+func withMetadata(pluginConfig config.Plugin, metadata plugin.Metadata) config.Plugin {
+	if pluginConfig.Name == "" {
+		pluginConfig.Name = metadata.Name
+	}
+	if pluginConfig.Description == "" {
+		pluginConfig.Description = metadata.Description
+	}
+	if pluginConfig.Usage == "" {
+		pluginConfig.Usage = metadata.Usage
+	}
+
+	t := pluginConfig.Triggers
+	if t.Prefix == "" && len(t.Commands) == 0 && len(t.Regexes) == 0 {
+		pluginConfig.Triggers = config.Triggers{
+			Prefix:   metadata.Triggers.Prefix,
+			Commands: metadata.Triggers.Commands,
+			Regexes:  metadata.Triggers.Regexes,
+		}
+	}
+
+	if !pluginConfig.OnlyChannels && !pluginConfig.OnlyDirectMessages && !pluginConfig.OnlyMentions {
+		pluginConfig.OnlyChannels = metadata.HasPermission("only_channels")
+		pluginConfig.OnlyDirectMessages = metadata.HasPermission("only_direct_messages")
+		pluginConfig.OnlyMentions = metadata.HasPermission("only_mentions")
+	}
+	return pluginConfig
+}
+
 func loadPlugins(config *config.Config) ([]*plugin.Plugin, error) {
 	var plugins []*plugin.Plugin
 	for _, pluginConfig := range config.Plugins {
-		plugin, err := plugin.New(
-			pluginConfig.Image,
-			pluginConfig.Environment,
-			ensureVolumeHasMountPoint(pluginConfig.Volumes),
-		)
+		runtime, name, metadata, err := newRuntime(pluginConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading plugin (image: %s, command: %s): %v", pluginConfig.Image, pluginConfig.Command, err)
+		}
+		pluginConfig = withMetadata(pluginConfig, metadata)
+		if pluginConfig.Name != "" {
+			name = pluginConfig.Name
+		}
+
+		var timeout time.Duration
+		if pluginConfig.Timeout != "" {
+			if timeout, err = time.ParseDuration(pluginConfig.Timeout); err != nil {
+				runtime.Stop()
+				return nil, fmt.Errorf("Error loading plugin (%s), invalid timeout: %v", name, err)
+			}
+		}
+
+		t := pluginConfig.Triggers
+		triggers, err := plugin.NewTriggers(t.Prefix, t.Commands, t.Regexes)
 		if err != nil {
-			return nil, fmt.Errorf("Error loading plugin (image: %s): %v", pluginConfig.Image, err)
+			runtime.Stop()
+			return nil, fmt.Errorf("Error loading plugin (%s), invalid trigger: %v", name, err)
+		}
+
+		switch pluginConfig.ReplyInThread {
+		case "", plugin.ReplyInThreadAlways, plugin.ReplyInThreadIfThreaded, plugin.ReplyInThreadNever:
+		default:
+			runtime.Stop()
+			return nil, fmt.Errorf("Error loading plugin (%s), invalid reply_in_thread: %s", name, pluginConfig.ReplyInThread)
 		}
 
+		plugin := plugin.New(name, runtime)
+
 		// TODO: this is a little bit ugly
+		plugin.Image = pluginConfig.Image
+		plugin.Description = pluginConfig.Description
+		plugin.Usage = pluginConfig.Usage
+		plugin.Timeout = timeout
+		plugin.TimeoutMessage = pluginConfig.TimeoutMessage
 		plugin.RunOnlyOnChannels = pluginConfig.OnlyChannels
 		plugin.RunOnlyOnDirectMessages = pluginConfig.OnlyDirectMessages
 		plugin.RunOnlyOnMentions = pluginConfig.OnlyMentions
+		plugin.RespondToBots = pluginConfig.RespondToBots
+		plugin.Triggers = triggers
+		plugin.ReplyInThread = pluginConfig.ReplyInThread
 
-		log.Infof("Plugin (%s) loaded.", pluginConfig.Image)
-		log.Debugf("Plugin (%s) config: %+v", pluginConfig.Image, pluginConfig)
+		log.Infof("Plugin (%s) loaded.", name)
+		log.Debugf("Plugin (%s) config: %+v", name, pluginConfig)
 		plugins = append(plugins, plugin)
 	}
 	return plugins, nil
@@ -84,6 +263,157 @@ func loadAdapters(config *config.Config) ([]adapter.Adapter, error) {
 	return adapters, nil
 }
 
+// replyThread returns the thread where the replies to the message m are sent
+// following the reply in thread policy of the plugin.
+func replyThread(replyInThread string, m adapter.Message) string {
+	switch replyInThread {
+	case plugin.ReplyInThreadAlways:
+		if m.Thread == "" {
+			// A new thread starts on the message
+			return m.ID
+		}
+		return m.Thread
+	case plugin.ReplyInThreadNever:
+		return ""
+	default:
+		return m.Thread
+	}
+}
+
+// replies returns the messages that need to be sent to the adapter for the
+// output of a plugin that was run for the message m. The messages without
+// thread or receiver are sent in the thread of the replies.
+func replies(m adapter.Message, thread string, output plugin.Output) []adapter.Message {
+	if output.Silent {
+		return nil
+	}
+
+	var messages []adapter.Message
+	for _, om := range output.Messages {
+		receiver, t, replyTo := om.Receiver, om.Thread, ""
+		if receiver == "" {
+			receiver, replyTo = m.Receiver, m.ID
+			if t == "" {
+				t = thread
+			}
+		}
+		messages = append(messages, adapter.Message{
+			Receiver: receiver,
+			Thread:   t,
+			Format:   om.Format,
+			Body:     om.Body,
+			ReplyTo:  replyTo,
+		})
+	}
+	for _, r := range output.Reactions {
+		messages = append(messages, adapter.Message{
+			Receiver: m.Receiver,
+			ID:       m.ID,
+			Reaction: r.Name,
+		})
+	}
+	return messages
+}
+
+// runPlugin runs the plugin for the message, sends its replies to the adapter
+// and returns the result of the run.
+func runPlugin(p *plugin.Plugin, m adapter.Message, matches map[string]string, reply func(adapter.Message), stderrCh chan error) adapter.Result {
+	log.Debugf("Running plugin (%s) for: %+v", p.Name, m)
+
+	input := plugin.NewInput(m.Emitter, m.Receiver, m.Body)
+	input.Thread = m.Thread
+	input.Matches = matches
+	thread := replyThread(p.ReplyInThread, m)
+
+	result := adapter.Result{Plugin: p.Name, Image: p.Image}
+	image := p.Image
+	if image == "" {
+		image = p.Name
+	}
+	start := time.Now()
+	stdout, stderr, err := p.Run(input)
+	result.Stdout, result.Stderr, result.Err = stdout, stderr, err
+	result.Duration = time.Since(start)
+
+	if err != nil {
+		stderrCh <- err
+		if _, ok := err.(*plugin.TimeoutError); ok && p.TimeoutMessage != "" {
+			r := adapter.Message{Receiver: m.Receiver, Thread: thread, Body: p.TimeoutMessage, Image: image, ReplyTo: m.ID}
+			reply(r)
+			result.Replies = append(result.Replies, r)
+		}
+		return result
+	}
+
+	log.Debugf("Plugin (%s) response: %s", p.Name, stdout)
+	if stderr != "" {
+		log.Errorf("Plugin (%s) threw an error: %s", p.Name, stderr)
+	}
+	for _, r := range replies(m, thread, plugin.ParseOutput(stdout)) {
+		r.Image = image
+		reply(r)
+		result.Replies = append(result.Replies, r)
+	}
+	return result
+}
+
+// dispatch runs the plugins that need to be run for the message. If the
+// adapter is a reporter it's told about the result of every plugin and when
+// all of them are done.
+func dispatch(a adapter.Adapter, plugins []*plugin.Plugin, guard *loopGuard, m adapter.Message, reply func(adapter.Message), stderrCh chan error) {
+	reporter, _ := a.(adapter.Reporter)
+	var wg sync.WaitGroup
+	defer func() {
+		if reporter != nil {
+			go func() {
+				wg.Wait()
+				reporter.Done(m)
+			}()
+		}
+	}()
+
+	if !guard.allow(m) {
+		log.Warningf("Too many replies to %s in a row, ignoring the bot: %+v", m.Receiver, m)
+		return
+	}
+	if !m.FromBot {
+		if r, ok := help(a, plugins, m); ok {
+			if reporter != nil {
+				reporter.Report(m, adapter.Result{Plugin: "help", Stdout: r.Body, Replies: []adapter.Message{r}})
+			}
+			go reply(r)
+			return
+		}
+	}
+
+	for _, p := range plugins {
+		if m.FromBot && !p.RespondToBots {
+			log.Debugf("Not running plugin (%s) for a bot: %+v", p.Name, m)
+			continue
+		}
+		if !a.ShouldRun(p, &m) {
+			log.Debugf("Not running plugin (%s) for: %+v", p.Name, m)
+			continue
+		}
+		matches, ok := p.Triggers.Match(m.Body)
+		if !ok {
+			log.Debugf("Plugin (%s) not triggered by: %+v", p.Name, m)
+			continue
+		}
+
+		// The plugins queue the runs by themselves, a slow plugin
+		// doesn't need to block the rest.
+		wg.Add(1)
+		go func(p *plugin.Plugin) {
+			defer wg.Done()
+			result := runPlugin(p, m, matches, reply, stderrCh)
+			if reporter != nil {
+				reporter.Report(m, result)
+			}
+		}(p)
+	}
+}
+
 func listenAndReply(adapters []adapter.Adapter, plugins []*plugin.Plugin) {
 	var wg sync.WaitGroup
 	signalsCh := make(chan os.Signal, 1)
@@ -94,30 +424,17 @@ func listenAndReply(adapters []adapter.Adapter, plugins []*plugin.Plugin) {
 
 		stdinCh, stdoutCh, stderrCh := a.RunAndAttach()
 		go func(a adapter.Adapter, stdinCh, stdoutCh chan adapter.Message, stderrCh chan error) {
+			guard := newLoopGuard()
+			reply := func(m adapter.Message) {
+				guard.record(m)
+				stdoutCh <- m
+			}
+
 			for {
 				select {
 				case m := <-stdinCh:
 					log.Debugf("Message received: %+v", m)
-					for _, p := range plugins {
-						if !a.ShouldRun(p, &m) {
-							log.Debugf("Not running plugin (%s) for: %+v", p.Image, m)
-							continue
-						}
-						log.Debugf("Running plugin (%s) for: %+v", p.Image, m)
-
-						stdout, stderr, err := p.Run(plugin.NewInput(m.Emitter, m.Receiver, m.Body))
-						if err != nil {
-							stderrCh <- err
-							continue
-						}
-						stdout = strings.TrimSuffix(stdout, "\n")
-
-						log.Debugf("Plugin (%s) response: %s", p.Image, stdout)
-						if stderr != "" {
-							log.Errorf("Plugin (%s) threw an error: %s", p.Image, stderr)
-						}
-						stdoutCh <- adapter.Message{Receiver: m.Receiver, Body: stdout}
-					}
+					dispatch(a, plugins, guard, m, reply, stderrCh)
 				case err := <-stderrCh:
 					log.Error(err)
 				case <-signalsCh:
@@ -132,6 +449,13 @@ func listenAndReply(adapters []adapter.Adapter, plugins []*plugin.Plugin) {
 	wg.Wait()
 
 	log.Info("Teardown...")
+	for _, a := range adapters {
+		if stopper, ok := a.(adapter.Stopper); ok {
+			if err := stopper.Stop(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
 	for _, plugin := range plugins {
 		plugin.Stop()
 	}
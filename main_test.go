@@ -5,7 +5,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/agonzalezro/botella/adapter"
 	"github.com/agonzalezro/botella/config"
+	"github.com/agonzalezro/botella/plugin"
 )
 
 func TestLoadPlugins(t *testing.T) {
@@ -35,6 +37,59 @@ func TestLoadPlugins(t *testing.T) {
 	assert.True(p.RunOnlyOnMentions)
 }
 
+func TestLoadExecPlugins(t *testing.T) {
+	assert := assert.New(t)
+
+	config := config.Config{
+		Plugins: []config.Plugin{{Runtime: "exec", Command: "cat"}},
+	}
+
+	plugins, err := loadPlugins(&config)
+	assert.NoError(err)
+	assert.Equal(1, len(plugins))
+
+	p := plugins[0]
+	defer p.Stop()
+	assert.Equal("cat", p.Name)
+
+	stdout, _, err := p.Run(plugin.NewInput("", "", "ping"))
+	assert.NoError(err)
+	assert.Contains(stdout, `"body":"ping"`)
+}
+
+func TestLoadPluginWithUnknownRuntime(t *testing.T) {
+	config := config.Config{
+		Plugins: []config.Plugin{{Runtime: "does-not-exist"}},
+	}
+
+	_, err := loadPlugins(&config)
+	assert.Error(t, err)
+}
+
+func TestLoadExecPluginsWithTriggers(t *testing.T) {
+	assert := assert.New(t)
+
+	config := config.Config{
+		Plugins: []config.Plugin{{
+			Runtime:  "exec",
+			Command:  "cat",
+			Triggers: config.Triggers{Prefix: "!", Commands: []string{"ping"}},
+		}},
+	}
+
+	plugins, err := loadPlugins(&config)
+	assert.NoError(err)
+	defer plugins[0].Stop()
+
+	matches, ok := plugins[0].Triggers.Match("!ping me")
+	assert.True(ok)
+	assert.Equal("me", matches["args"])
+
+	config.Plugins[0].Triggers.Regexes = []string{"("}
+	_, err = loadPlugins(&config)
+	assert.Error(err)
+}
+
 func TestLoadPluginThatErrors(t *testing.T) {
 	pluginConfig := config.Plugin{Image: "this-plugin-does-not-exist"}
 	config := config.Config{
@@ -86,3 +141,195 @@ func TestVolumePathsCleaning(t *testing.T) {
 		ensureVolumeHasMountPoint(volumes),
 	)
 }
+
+func TestParseMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := map[string]int64{
+		"":     0,
+		"1024": 1024,
+		"10b":  10,
+		"512k": 512 * 1024,
+		"256m": 256 * 1024 * 1024,
+		"1G":   1024 * 1024 * 1024,
+	}
+	for in, expected := range cases {
+		memory, err := parseMemory(in)
+		assert.NoError(err)
+		assert.Equal(expected, memory, in)
+	}
+
+	for _, in := range []string{"m", "lots", "-1m"} {
+		_, err := parseMemory(in)
+		assert.Error(err, in)
+	}
+}
+
+func TestTmpfsAsMap(t *testing.T) {
+	assert.EqualValues(
+		t,
+		map[string]string{"/tmp": "", "/run": "rw,size=64m"},
+		tmpfsAsMap([]string{"/tmp", "/run:rw,size=64m"}),
+	)
+}
+
+func TestReplies(t *testing.T) {
+	assert := assert.New(t)
+
+	m := adapter.Message{ID: "1234.5678", Receiver: "C1", Body: "ping"}
+
+	assert.Equal(
+		[]adapter.Message{{Receiver: "C1", Body: "pong", ReplyTo: "1234.5678"}},
+		replies(m, "", plugin.ParseOutput("pong\n")),
+	)
+
+	assert.Equal(
+		[]adapter.Message{
+			{Receiver: "C1", Body: "pong", ReplyTo: "1234.5678"},
+			{Receiver: "U1", Thread: "1.2", Format: plugin.FormatCode, Body: "ls"},
+			{Receiver: "C1", ID: "1234.5678", Reaction: "thumbsup"},
+		},
+		replies(m, "", plugin.Output{
+			Version: plugin.ProtocolVersion,
+			Messages: []plugin.OutputMessage{
+				{Body: "pong"},
+				{Receiver: "U1", Thread: "1.2", Format: plugin.FormatCode, Body: "ls"},
+			},
+			Reactions: []plugin.Reaction{{Name: "thumbsup"}},
+		}),
+	)
+
+	assert.Empty(replies(m, "", plugin.Output{Version: plugin.ProtocolVersion, Silent: true}))
+
+	// Only the messages to the same receiver are sent to the thread
+	assert.Equal(
+		[]adapter.Message{
+			{Receiver: "C1", Thread: "1234.5678", Body: "pong", ReplyTo: "1234.5678"},
+			{Receiver: "C1", Thread: "1.2", Body: "ping", ReplyTo: "1234.5678"},
+			{Receiver: "U1", Body: "psst"},
+		},
+		replies(m, "1234.5678", plugin.Output{
+			Version: plugin.ProtocolVersion,
+			Messages: []plugin.OutputMessage{
+				{Body: "pong"},
+				{Thread: "1.2", Body: "ping"},
+				{Receiver: "U1", Body: "psst"},
+			},
+		}),
+	)
+}
+
+func TestReplyThread(t *testing.T) {
+	assert := assert.New(t)
+
+	inChannel := adapter.Message{ID: "1.1"}
+	inThread := adapter.Message{ID: "1.2", Thread: "1.1"}
+
+	assert.Equal("1.1", replyThread(plugin.ReplyInThreadAlways, inChannel))
+	assert.Equal("1.1", replyThread(plugin.ReplyInThreadAlways, inThread))
+	assert.Equal("", replyThread(plugin.ReplyInThreadIfThreaded, inChannel))
+	assert.Equal("1.1", replyThread(plugin.ReplyInThreadIfThreaded, inThread))
+	assert.Equal("1.1", replyThread("", inThread))
+	assert.Equal("", replyThread(plugin.ReplyInThreadNever, inThread))
+}
+
+func TestWithMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata := plugin.Metadata{Name: "deployer", Usage: "!deploy <app>", Permissions: []string{"only_mentions"}}
+	metadata.Triggers.Prefix = "!"
+	metadata.Triggers.Commands = []string{"deploy"}
+
+	pluginConfig := withMetadata(config.Plugin{Image: "team/deployer"}, metadata)
+	assert.Equal("deployer", pluginConfig.Name)
+	assert.Equal("!deploy <app>", pluginConfig.Usage)
+	assert.Equal(config.Triggers{Prefix: "!", Commands: []string{"deploy"}}, pluginConfig.Triggers)
+	assert.True(pluginConfig.OnlyMentions)
+	assert.False(pluginConfig.OnlyChannels)
+
+	pluginConfig = withMetadata(config.Plugin{
+		Name:         "deploy",
+		Triggers:     config.Triggers{Regexes: []string{"^ship it$"}},
+		OnlyChannels: true,
+	}, metadata)
+	assert.Equal("deploy", pluginConfig.Name)
+	assert.Equal(config.Triggers{Regexes: []string{"^ship it$"}}, pluginConfig.Triggers)
+	assert.True(pluginConfig.OnlyChannels)
+	assert.False(pluginConfig.OnlyMentions)
+}
+
+// reportingAdapter is an adapter that collects what's reported
+type reportingAdapter struct {
+	results chan adapter.Result
+	done    chan adapter.Message
+}
+
+func (reportingAdapter) RunAndAttach() (chan adapter.Message, chan adapter.Message, chan error) {
+	return nil, nil, nil
+}
+
+func (reportingAdapter) ShouldRun(*plugin.Plugin, *adapter.Message) bool { return true }
+
+func (ra reportingAdapter) Report(_ adapter.Message, r adapter.Result) { ra.results <- r }
+
+func (ra reportingAdapter) Done(m adapter.Message) { ra.done <- m }
+
+func TestDispatchReports(t *testing.T) {
+	assert := assert.New(t)
+
+	plugins, err := loadPlugins(&config.Config{
+		Plugins: []config.Plugin{
+			{Runtime: "exec", Command: "echo pong"},
+			{Runtime: "exec", Command: "echo deployed", Triggers: config.Triggers{Commands: []string{"deploy"}}},
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	for _, p := range plugins {
+		defer p.Stop()
+	}
+
+	ra := reportingAdapter{results: make(chan adapter.Result, 2), done: make(chan adapter.Message)}
+	stdoutCh := make(chan adapter.Message, 2)
+	reply := func(m adapter.Message) { stdoutCh <- m }
+	m := adapter.Message{Receiver: "C1", Body: "ping"}
+
+	dispatch(ra, plugins, newLoopGuard(), m, reply, make(chan error, 1))
+	assert.Equal(m, <-ra.done)
+
+	result := <-ra.results
+	assert.Equal("echo pong", result.Plugin)
+	assert.Equal("pong\n", result.Stdout)
+	assert.NoError(result.Err)
+	assert.Equal([]adapter.Message{{Receiver: "C1", Body: "pong", Image: "echo pong"}}, result.Replies)
+	assert.Equal(result.Replies[0], <-stdoutCh)
+	assert.Empty(ra.results, "the deploy plugin wasn't triggered")
+
+	// Even if nothing is run the adapter needs to know that it's done
+	dispatch(ra, nil, newLoopGuard(), m, reply, make(chan error, 1))
+	assert.Equal(m, <-ra.done)
+}
+
+func TestDispatchHelpFallsThrough(t *testing.T) {
+	assert := assert.New(t)
+
+	plugins, err := loadPlugins(&config.Config{
+		Plugins: []config.Plugin{{Runtime: "exec", Command: "echo on it"}},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	for _, p := range plugins {
+		defer p.Stop()
+	}
+
+	ra := reportingAdapter{results: make(chan adapter.Result, 1), done: make(chan adapter.Message, 1)}
+	reply := func(adapter.Message) {}
+
+	dispatch(ra, plugins, newLoopGuard(), adapter.Message{Receiver: "C1", Body: "help me with prod"}, reply, make(chan error, 1))
+	assert.Equal("echo on it", (<-ra.results).Plugin)
+
+	dispatch(ra, plugins, newLoopGuard(), adapter.Message{Receiver: "C1", Body: "help echo on it"}, reply, make(chan error, 1))
+	assert.Equal("help", (<-ra.results).Plugin)
+}
@@ -0,0 +1,273 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// DockerOptions are the options used to create the container of a plugin.
+type DockerOptions struct {
+	// Image can be pinned to a digest (image@sha256:xxx), the digest is
+	// checked after pulling it.
+	Image       string
+	Environment map[string]string
+	Volumes     []string
+
+	// PullPolicy is one of PullAlways (default), PullIfNotPresent or PullNever
+	PullPolicy string
+	// Auth are the registry credentials: username, password, email and
+	// server_address. If they are empty ~/.docker/config.json is used.
+	Auth map[string]string
+
+	// Persistent keeps the stdin of the container open between runs
+	Persistent bool
+
+	// Resource limits, 0 means no limit
+	Memory    int64 // in bytes
+	CPUShares int64
+	CPUQuota  int64
+	PidsLimit int64
+
+	// Hardening options
+	ReadOnly        bool
+	CapDrop         []string
+	NoNewPrivileges bool
+	User            string
+	// Tmpfs are the paths where a tmpfs is mounted with its mount options
+	Tmpfs       map[string]string
+	NetworkMode string
+}
+
+func (do DockerOptions) hostConfig() *docker.HostConfig {
+	hc := &docker.HostConfig{
+		Binds:          do.Volumes,
+		Memory:         do.Memory,
+		CPUShares:      do.CPUShares,
+		CPUQuota:       do.CPUQuota,
+		PidsLimit:      do.PidsLimit,
+		ReadonlyRootfs: do.ReadOnly,
+		CapDrop:        do.CapDrop,
+		Tmpfs:          do.Tmpfs,
+		NetworkMode:    do.NetworkMode,
+	}
+	if do.NoNewPrivileges {
+		hc.SecurityOpt = append(hc.SecurityOpt, "no-new-privileges")
+	}
+	return hc
+}
+
+// DockerRuntime runs the plugin inside a Docker container, the container is
+// created once and started again on every run.
+type DockerRuntime struct {
+	options   DockerOptions
+	client    *docker.Client
+	container *docker.Container
+	metadata  Metadata
+}
+
+func NewDockerRuntime(options DockerOptions) (*DockerRuntime, error) {
+	client, err := docker.NewClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := pullImage(client, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels map[string]string
+	if image.Config != nil {
+		labels = image.Config.Labels
+	}
+	metadata, err := ParseLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	if missing := missingEnvironment(options.Image, options.Environment, metadata.RequiredEnv); len(missing) > 0 {
+		return nil, fmt.Errorf("image %s requires the environment variables: %s", options.Image, strings.Join(missing, ", "))
+	}
+
+	dr, err := newDockerRuntime(client, options)
+	if err != nil {
+		return nil, err
+	}
+	dr.metadata = metadata
+	return dr, nil
+}
+
+// pullImage makes sure that the image is present following the pull policy
+// and returns it.
+func pullImage(client *docker.Client, options DockerOptions) (*docker.Image, error) {
+	image, err := client.InspectImage(options.Image)
+	if err != nil && err != docker.ErrNoSuchImage {
+		return nil, err
+	}
+
+	switch options.PullPolicy {
+	case "", PullAlways:
+		image = nil
+	case PullIfNotPresent:
+	case PullNever:
+		if image == nil {
+			return nil, fmt.Errorf("image %s not present and the pull policy is %s", options.Image, PullNever)
+		}
+	default:
+		return nil, fmt.Errorf("unknown pull policy: %s", options.PullPolicy)
+	}
+
+	if image == nil {
+		dockerCfg, err := docker.NewAuthConfigurationsFromDockerCfg()
+		if err != nil {
+			log.Debugf("Docker config not loaded: %v", err)
+		}
+		if err := client.PullImage(
+			docker.PullImageOptions{Repository: options.Image},
+			registryAuth(options.Image, options.Auth, dockerCfg),
+		); err != nil {
+			return nil, err
+		}
+
+		if image, err = client.InspectImage(options.Image); err != nil {
+			return nil, err
+		}
+	}
+
+	if digest := digestOf(options.Image); digest != "" && !hasDigest(image.RepoDigests, digest) {
+		return nil, fmt.Errorf("image %s doesn't match its digest, found: %v", options.Image, image.RepoDigests)
+	}
+	return image, nil
+}
+
+// newDockerRuntime creates the container for an image already pulled.
+func newDockerRuntime(client *docker.Client, options DockerOptions) (*DockerRuntime, error) {
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:        options.Image,
+			Env:          environmentAsArrayOfString(options.Image, options.Environment),
+			AttachStdin:  true, // TODO: not sure what of these are needed
+			AttachStdout: true,
+			OpenStdin:    true,
+			StdinOnce:    !options.Persistent,
+			User:         options.User,
+		},
+		HostConfig: options.hostConfig(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Plugin/Container (%s) created: %+v", options.Image, container)
+	return &DockerRuntime{options: options, client: client, container: container}, nil
+}
+
+// Metadata returns what the labels of the image say about the plugin.
+func (dr *DockerRuntime) Metadata() Metadata {
+	return dr.metadata
+}
+
+func (dr *DockerRuntime) clone() (Runtime, error) {
+	clone, err := newDockerRuntime(dr.client, dr.options)
+	if err != nil {
+		return nil, err
+	}
+	clone.metadata = dr.metadata
+	return clone, nil
+}
+
+func (dr *DockerRuntime) Stop() error {
+	return dr.client.RemoveContainer(
+		docker.RemoveContainerOptions{ID: dr.container.ID, Force: true})
+}
+
+func (dr *DockerRuntime) Run(ctx context.Context, input Input) (string, string, error) {
+	// TODO: not sure if we should do this or keep an ongoing container running
+	if err := dr.client.StartContainer(dr.container.ID, nil); err != nil {
+		return "", "", err
+	}
+
+	// Once the container is killed the attach & wait below return
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := dr.kill(); err != nil {
+				log.Warningf("Error killing the container (%s): %v", dr.container.ID, err)
+			}
+		case <-done:
+		}
+	}()
+
+	var outBuf, errBuf bytes.Buffer
+	if err := dr.client.AttachToContainer(docker.AttachToContainerOptions{
+		Container:    dr.container.ID,
+		Stdin:        true,
+		Stdout:       true,
+		Stderr:       true,
+		InputStream:  strings.NewReader(input.JSON()),
+		OutputStream: &outBuf,
+		ErrorStream:  &errBuf,
+		Stream:       true,
+	}); err != nil {
+		return "", "", err
+	}
+
+	if _, err := dr.client.WaitContainer(dr.container.ID); err != nil {
+		return "", "", err
+	}
+
+	return outBuf.String(), errBuf.String(), nil
+}
+
+func (dr *DockerRuntime) startSession() (*session, error) {
+	if err := dr.client.StartContainer(dr.container.ID, nil); err != nil {
+		return nil, err
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	cw, err := dr.client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
+		Container:    dr.container.ID,
+		Stdin:        true,
+		Stdout:       true,
+		Stderr:       true,
+		InputStream:  stdinReader,
+		OutputStream: stdoutWriter,
+		ErrorStream:  stderrLogger{dr.options.Image},
+		Stream:       true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The attach finishes when the container exits, that's when the frames
+	// reader needs to know that there is nothing else to read.
+	go func() {
+		cw.Wait()
+		stdoutWriter.Close()
+		stdinReader.Close()
+	}()
+
+	wait := func() error {
+		_, err := dr.client.WaitContainer(dr.container.ID)
+		return err
+	}
+	return &session{stdin: stdinWriter, stdout: stdoutReader, wait: wait, kill: dr.kill}, nil
+}
+
+func (dr *DockerRuntime) kill() error {
+	return dr.client.KillContainer(docker.KillContainerOptions{ID: dr.container.ID})
+}
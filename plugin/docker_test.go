@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerHostConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	options := DockerOptions{
+		Volumes:         []string{"/tmp:/tmp"},
+		Memory:          256 * 1024 * 1024,
+		CPUShares:       512,
+		CPUQuota:        50000,
+		PidsLimit:       64,
+		ReadOnly:        true,
+		CapDrop:         []string{"ALL"},
+		NoNewPrivileges: true,
+		Tmpfs:           map[string]string{"/run": "size=64m"},
+		NetworkMode:     "none",
+	}
+
+	hc := options.hostConfig()
+	assert.Equal([]string{"/tmp:/tmp"}, hc.Binds)
+	assert.Equal(int64(256*1024*1024), hc.Memory)
+	assert.Equal(int64(512), hc.CPUShares)
+	assert.Equal(int64(50000), hc.CPUQuota)
+	assert.Equal(int64(64), hc.PidsLimit)
+	assert.True(hc.ReadonlyRootfs)
+	assert.Equal([]string{"ALL"}, hc.CapDrop)
+	assert.Equal([]string{"no-new-privileges"}, hc.SecurityOpt)
+	assert.Equal(map[string]string{"/run": "size=64m"}, hc.Tmpfs)
+	assert.Equal("none", hc.NetworkMode)
+}
+
+func TestDockerHostConfigWithoutLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	hc := DockerOptions{}.hostConfig()
+	assert.Zero(hc.PidsLimit)
+	assert.Nil(hc.SecurityOpt)
+	assert.Equal(int64(0), hc.Memory)
+}
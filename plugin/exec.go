@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ExecOptions are the options used to run a plugin as a local process.
+type ExecOptions struct {
+	// Command is the binary or script to run, it can contain arguments
+	// separated by spaces: "./scripts/ping.sh --verbose"
+	Command     string
+	Environment map[string]string
+}
+
+// ExecRuntime runs the plugin as a local process, it follows the same
+// contract than the containers: JSON on stdin and text on stdout.
+type ExecRuntime struct {
+	command string
+
+	path string
+	args []string
+	env  []string
+}
+
+func NewExecRuntime(options ExecOptions) (*ExecRuntime, error) {
+	fields := strings.Fields(options.Command)
+	if len(fields) == 0 {
+		return nil, errors.New("the exec runtime requires a command")
+	}
+
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// The process inherits the environment of botella (PATH, HOME...), the
+	// values defined on the config are added on top of it. The empty ones are
+	// taken from the env vars prefixed by the name of the binary, without its
+	// path or arguments: PING_SH_KEY for "./scripts/ping.sh --verbose".
+	prefix := filepath.Base(fields[0])
+	env := append(os.Environ(), environmentAsArrayOfString(prefix, options.Environment)...)
+
+	return &ExecRuntime{command: options.Command, path: path, args: fields[1:], env: env}, nil
+}
+
+func (er *ExecRuntime) clone() (Runtime, error) {
+	clone := *er
+	return &clone, nil
+}
+
+func (er *ExecRuntime) Stop() error {
+	// Nothing to clean up, every run is a new process
+	return nil
+}
+
+func (er *ExecRuntime) Run(ctx context.Context, input Input) (string, string, error) {
+	var outBuf, errBuf bytes.Buffer
+
+	cmd := er.newCmd()
+	cmd.Stdin = strings.NewReader(input.JSON())
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			kill(cmd)
+		case <-done:
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		// A plugin exiting with a non zero code is still a valid run, the
+		// same way it is for the containers.
+		if _, ok := err.(*exec.ExitError); !ok {
+			return "", "", err
+		}
+	}
+
+	return outBuf.String(), errBuf.String(), nil
+}
+
+func (er *ExecRuntime) startSession() (*session, error) {
+	cmd := er.newCmd()
+	cmd.Stderr = stderrLogger{er.command}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &session{
+		stdin:  stdin,
+		stdout: stdout,
+		wait:   cmd.Wait,
+		kill:   func() error { return kill(cmd) },
+	}, nil
+}
+
+func (er *ExecRuntime) newCmd() *exec.Cmd {
+	cmd := exec.Command(er.path, er.args...)
+	cmd.Env = er.env
+	// The process gets its own group, that way we can kill its children too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// kill kills the process and all its children, scripts usually leave some of
+// them behind holding the stdout open.
+func kill(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
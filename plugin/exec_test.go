@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecRuntimeRun(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := NewExecRuntime(ExecOptions{Command: "cat"})
+	assert.NoError(err)
+	defer r.Stop()
+
+	input := NewInput("emitter", "receiver", "ping")
+	stdout, stderr, err := r.Run(context.Background(), input)
+	assert.NoError(err)
+	assert.Equal(input.JSON(), stdout)
+	assert.Equal("", stderr)
+}
+
+func TestExecRuntimeOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := NewExecRuntime(ExecOptions{
+		Command:     "cat -u -",
+		Environment: map[string]string{"KEY": "value"},
+	})
+	assert.NoError(err)
+	assert.Contains(r.env, "KEY=value")
+	assert.Equal([]string{"-u", "-"}, r.args)
+}
+
+func TestExecRuntimeEnvironmentFromEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	// The prefix is the name of the binary, without its path or arguments
+	assert.NoError(os.Setenv("CAT_SECRET", "from-env"))
+	defer os.Unsetenv("CAT_SECRET")
+
+	r, err := NewExecRuntime(ExecOptions{
+		Command:     "/bin/cat -u",
+		Environment: map[string]string{"SECRET": ""},
+	})
+	assert.NoError(err)
+	assert.Contains(r.env, "SECRET=from-env")
+}
+
+func TestExecRuntimeNotFound(t *testing.T) {
+	_, err := NewExecRuntime(ExecOptions{Command: "this-command-does-not-exist"})
+	assert.Error(t, err)
+
+	_, err = NewExecRuntime(ExecOptions{})
+	assert.Error(t, err)
+}
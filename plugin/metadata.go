@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Labels of the images that botella understands.
+const (
+	LabelName        = "io.botella.name"
+	LabelDescription = "io.botella.description"
+	LabelHelp        = "io.botella.help"
+	LabelTriggers    = "io.botella.triggers"
+	LabelPermissions = "io.botella.permissions"
+	LabelRequiredEnv = "io.botella.env.required"
+)
+
+// Metadata is what the plugin author tells us about the plugin, it's used as
+// the default values of the plugin config.
+type Metadata struct {
+	Name        string
+	Description string
+	// Usage is read from the help label
+	Usage string
+	// Triggers is a JSON document on the label:
+	// {"prefix": "!", "commands": ["deploy"], "regexes": ["^ping$"]}
+	Triggers struct {
+		Prefix   string   `json:"prefix"`
+		Commands []string `json:"commands"`
+		Regexes  []string `json:"regexes"`
+	}
+	// Permissions are any of only_channels, only_direct_messages or
+	// only_mentions separated by commas.
+	Permissions []string
+	// RequiredEnv are the names of the environment variables that the
+	// plugin needs to work, separated by commas.
+	RequiredEnv []string
+}
+
+// splitList splits a list of values separated by commas.
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ParseLabels reads the metadata from the labels of an image.
+func ParseLabels(labels map[string]string) (Metadata, error) {
+	m := Metadata{
+		Name:        labels[LabelName],
+		Description: labels[LabelDescription],
+		Usage:       labels[LabelHelp],
+		Permissions: splitList(labels[LabelPermissions]),
+		RequiredEnv: splitList(labels[LabelRequiredEnv]),
+	}
+
+	if triggers := labels[LabelTriggers]; triggers != "" {
+		if err := json.Unmarshal([]byte(triggers), &m.Triggers); err != nil {
+			return m, fmt.Errorf("invalid %s label: %v", LabelTriggers, err)
+		}
+	}
+
+	for _, p := range m.Permissions {
+		switch p {
+		case "only_channels", "only_direct_messages", "only_mentions":
+		default:
+			return m, fmt.Errorf("invalid %s label, unknown permission: %s", LabelPermissions, p)
+		}
+	}
+	return m, nil
+}
+
+// HasPermission checks if the permission is one of the metadata permissions.
+func (m Metadata) HasPermission(permission string) bool {
+	for _, p := range m.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// missingEnvironment returns the required variables that don't have a value
+// on the environment of the plugin, neither on the environment of botella.
+func missingEnvironment(prefix string, environment map[string]string, required []string) []string {
+	values := make(map[string]bool)
+	for _, kv := range environmentAsArrayOfString(prefix, environment) {
+		if fragments := strings.SplitN(kv, "=", 2); fragments[1] != "" {
+			values[fragments[0]] = true
+		}
+	}
+
+	var missing []string
+	for _, k := range required {
+		if !values[k] {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata, err := ParseLabels(map[string]string{
+		LabelName:        "deployer",
+		LabelDescription: "Deploys our apps",
+		LabelHelp:        "!deploy <app> to <env>",
+		LabelTriggers:    `{"prefix": "!", "commands": ["deploy"], "regexes": ["^ship it$"]}`,
+		LabelPermissions: "only_channels, only_mentions",
+		LabelRequiredEnv: "TOKEN,REGION",
+		"maintainer":     "someone",
+	})
+	assert.NoError(err)
+	assert.Equal("deployer", metadata.Name)
+	assert.Equal("Deploys our apps", metadata.Description)
+	assert.Equal("!deploy <app> to <env>", metadata.Usage)
+	assert.Equal("!", metadata.Triggers.Prefix)
+	assert.Equal([]string{"deploy"}, metadata.Triggers.Commands)
+	assert.Equal([]string{"^ship it$"}, metadata.Triggers.Regexes)
+	assert.True(metadata.HasPermission("only_mentions"))
+	assert.False(metadata.HasPermission("only_direct_messages"))
+	assert.Equal([]string{"TOKEN", "REGION"}, metadata.RequiredEnv)
+
+	metadata, err = ParseLabels(nil)
+	assert.NoError(err)
+	assert.Empty(metadata.Name)
+	assert.Empty(metadata.RequiredEnv)
+
+	_, err = ParseLabels(map[string]string{LabelTriggers: "!deploy"})
+	assert.Error(err)
+
+	_, err = ParseLabels(map[string]string{LabelPermissions: "only_admins"})
+	assert.Error(err)
+}
+
+func TestMissingEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("TEAM_DEPLOYER_REGION", "eu-west-1")
+	defer os.Unsetenv("TEAM_DEPLOYER_REGION")
+
+	missing := missingEnvironment(
+		"team/deployer",
+		map[string]string{"TOKEN": "", "REGION": "", "DEBUG": "1"},
+		[]string{"TOKEN", "REGION", "DEBUG", "USER"},
+	)
+	assert.Equal([]string{"TOKEN", "USER"}, missing)
+}
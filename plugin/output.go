@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ProtocolVersion is the version of the protocol spoken with the plugins, it's
+// sent on every input. Plugins speaking the same version can reply with a JSON
+// document (see Output) instead of plain text.
+const ProtocolVersion = 1
+
+// Formats of the body of the messages.
+const (
+	FormatText     = "text"
+	FormatMarkdown = "markdown"
+	FormatCode     = "code"
+)
+
+// Output is the reply of a plugin.
+type Output struct {
+	Version   int             `json:"version"`
+	Messages  []OutputMessage `json:"messages,omitempty"`
+	Reactions []Reaction      `json:"reactions,omitempty"`
+	// Silent means that the plugin doesn't want to reply at all
+	Silent bool `json:"silent,omitempty"`
+}
+
+type OutputMessage struct {
+	// Receiver is who receives the message, by default the receiver of
+	// the input. For example, a channel or a user for a direct message.
+	Receiver string `json:"receiver,omitempty"`
+	// Thread is where the message is posted inside the receiver
+	Thread string `json:"thread,omitempty"`
+	// Format is one of FormatText (default), FormatMarkdown or FormatCode
+	Format string `json:"format,omitempty"`
+	Body   string `json:"body"`
+}
+
+// Reaction is an emoji added to the message that triggered the plugin.
+type Reaction struct {
+	Name string `json:"name"`
+}
+
+// ParseOutput parses what the plugin wrote to its stdout. If it's not a JSON
+// document of the current protocol version it's just plain text, and that
+// text is the body of the reply.
+func ParseOutput(stdout string) Output {
+	trimmed := strings.TrimSpace(stdout)
+	if strings.HasPrefix(trimmed, "{") {
+		var output Output
+		if err := json.Unmarshal([]byte(trimmed), &output); err == nil && output.Version == ProtocolVersion {
+			return output
+		}
+	}
+
+	return Output{
+		Messages: []OutputMessage{{Body: strings.TrimSuffix(stdout, "\n")}},
+	}
+}
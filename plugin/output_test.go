@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlainOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := map[string]string{
+		"pong\n":                  "pong",
+		"multiple\nlines\n":       "multiple\nlines",
+		`{"not": "our protocol"}`: `{"not": "our protocol"}`,
+		`{"version": 2}`:          `{"version": 2}`,
+		`{"version": 1`:           `{"version": 1`,
+	}
+	for in, expected := range cases {
+		output := ParseOutput(in)
+		assert.False(output.Silent)
+		assert.Equal([]OutputMessage{{Body: expected}}, output.Messages, in)
+	}
+}
+
+func TestParseV1Output(t *testing.T) {
+	assert := assert.New(t)
+
+	output := ParseOutput(`{
+		"version": 1,
+		"messages": [
+			{"body": "pong"},
+			{"receiver": "U1", "thread": "123.456", "format": "code", "body": "ls -l"}
+		],
+		"reactions": [{"name": "thumbsup"}]
+	}` + "\n")
+
+	assert.False(output.Silent)
+	assert.Equal([]OutputMessage{
+		{Body: "pong"},
+		{Receiver: "U1", Thread: "123.456", Format: FormatCode, Body: "ls -l"},
+	}, output.Messages)
+	assert.Equal([]Reaction{{Name: "thumbsup"}}, output.Reactions)
+}
+
+func TestParseSilentOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	output := ParseOutput(`{"version": 1, "silent": true}`)
+	assert.True(output.Silent)
+	assert.Empty(output.Messages)
+}
@@ -0,0 +1,296 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// minBackoff and maxBackoff limit the time waited before restarting a
+	// persistent plugin that died.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	errSessionDied = errors.New("the plugin process died before replying")
+	errStopped     = errors.New("the persistent plugin was stopped")
+)
+
+// session is a long running plugin process that we can talk to line by line.
+type session struct {
+	stdin  io.WriteCloser
+	stdout io.Reader
+	// wait blocks until the process exits
+	wait func() error
+	kill func() error
+}
+
+// sessionStarter is implemented by the runtimes that can be run in
+// persistent mode.
+type sessionStarter interface {
+	startSession() (*session, error)
+}
+
+// frame is what a persistent plugin writes back for every input, one per line.
+type frame struct {
+	ID     string `json:"id"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// response is what a run waits for: a frame or the reason why it'll never come.
+type response struct {
+	frame frame
+	err   error
+}
+
+// PersistentRuntime keeps the plugin process running between runs, every
+// input is written as a line of JSON and the plugin replies with a line of
+// JSON (a frame) with the same ID. If the process dies it's restarted.
+type PersistentRuntime struct {
+	runtime Runtime
+	starter sessionStarter
+
+	lastID uint64
+	// writeMu avoids interleaving the lines written by concurrent runs
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	session *session
+	// ready is closed while there is a session running or once the runtime
+	// is stopped, the runs wait for it.
+	ready   chan struct{}
+	pending map[string]chan response
+	stopped bool
+}
+
+// NewPersistentRuntime wraps the given runtime to run it in persistent mode.
+func NewPersistentRuntime(runtime Runtime) (*PersistentRuntime, error) {
+	starter, ok := runtime.(sessionStarter)
+	if !ok {
+		return nil, fmt.Errorf("runtime %T can't be run in persistent mode", runtime)
+	}
+
+	pr := &PersistentRuntime{
+		runtime: runtime,
+		starter: starter,
+		ready:   make(chan struct{}),
+		pending: make(map[string]chan response),
+	}
+	go pr.supervise()
+	return pr, nil
+}
+
+// supervise (re)starts the plugin process with an exponential backoff and
+// reads its frames until it's stopped.
+func (pr *PersistentRuntime) supervise() {
+	backoff := minBackoff
+	for {
+		if pr.isStopped() {
+			return
+		}
+
+		startedAt := time.Now()
+		s, err := pr.starter.startSession()
+		if err != nil {
+			log.Errorf("Error starting persistent plugin: %v", err)
+		} else {
+			pr.mu.Lock()
+			stopped := pr.stopped
+			if !stopped {
+				pr.session = s
+				close(pr.ready)
+			}
+			pr.mu.Unlock()
+			if stopped {
+				s.kill()
+				return
+			}
+
+			pr.read(s)
+			if err := s.wait(); err != nil {
+				log.Warningf("Persistent plugin exited: %v", err)
+			}
+
+			pr.mu.Lock()
+			pr.detach(s)
+			for id, ch := range pr.pending {
+				ch <- response{err: errSessionDied}
+				delete(pr.pending, id)
+			}
+			pr.mu.Unlock()
+		}
+
+		if pr.isStopped() {
+			return
+		}
+
+		// If the process was running for long enough it wasn't a crash loop
+		if time.Since(startedAt) > maxBackoff {
+			backoff = minBackoff
+		}
+		log.Infof("Restarting persistent plugin in %s", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// read sends every frame read from the session to whoever is waiting for it.
+func (pr *PersistentRuntime) read(s *session) {
+	scanner := bufio.NewScanner(s.stdout)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var f frame
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			log.Warningf("Invalid frame from persistent plugin (%s): %v", line, err)
+			continue
+		}
+
+		pr.mu.Lock()
+		ch, ok := pr.pending[f.ID]
+		delete(pr.pending, f.ID)
+		pr.mu.Unlock()
+		if !ok {
+			log.Warningf("Nobody is waiting for the frame: %s", line)
+			continue
+		}
+		ch <- response{frame: f}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Warningf("Error reading from persistent plugin: %v", err)
+	}
+}
+
+// detach forgets the session, so the next runs wait for a new one. It's a
+// no-op if it was already detached. The lock must be held.
+func (pr *PersistentRuntime) detach(s *session) {
+	if pr.session != s {
+		return
+	}
+	pr.session = nil
+	if !pr.stopped {
+		pr.ready = make(chan struct{})
+	}
+}
+
+func (pr *PersistentRuntime) isStopped() bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.stopped
+}
+
+func (pr *PersistentRuntime) Run(ctx context.Context, input Input) (string, string, error) {
+	input.ID = strconv.FormatUint(atomic.AddUint64(&pr.lastID, 1), 10)
+	ch := make(chan response, 1)
+
+	// The process could be starting or restarting, wait for it
+	var s *session
+	for s == nil {
+		pr.mu.Lock()
+		if pr.stopped {
+			pr.mu.Unlock()
+			return "", "", errStopped
+		}
+		s = pr.session
+		ready := pr.ready
+		if s != nil {
+			pr.pending[input.ID] = ch
+		}
+		pr.mu.Unlock()
+
+		if s == nil {
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return "", "", ctx.Err()
+			}
+		}
+	}
+
+	pr.writeMu.Lock()
+	_, err := io.WriteString(s.stdin, input.JSON()+"\n")
+	pr.writeMu.Unlock()
+	if err != nil {
+		pr.mu.Lock()
+		delete(pr.pending, input.ID)
+		pr.mu.Unlock()
+		return "", "", err
+	}
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return "", "", r.err
+		}
+		return r.frame.Stdout, r.frame.Stderr, nil
+	case <-ctx.Done():
+		pr.mu.Lock()
+		delete(pr.pending, input.ID)
+		pr.detach(s)
+		pr.mu.Unlock()
+
+		// The process is probably stuck, it will be restarted
+		if err := s.kill(); err != nil {
+			log.Warningf("Error killing persistent plugin: %v", err)
+		}
+		return "", "", ctx.Err()
+	}
+}
+
+func (pr *PersistentRuntime) clone() (Runtime, error) {
+	c, ok := pr.runtime.(cloner)
+	if !ok {
+		return nil, fmt.Errorf("runtime %T can't be cloned", pr.runtime)
+	}
+	runtime, err := c.clone()
+	if err != nil {
+		return nil, err
+	}
+	return NewPersistentRuntime(runtime)
+}
+
+func (pr *PersistentRuntime) Stop() error {
+	pr.mu.Lock()
+	wasStopped := pr.stopped
+	pr.stopped = true
+	s := pr.session
+	if s == nil && !wasStopped {
+		// Nobody waits for a process that is never going to start
+		close(pr.ready)
+	}
+	pr.mu.Unlock()
+
+	if s != nil {
+		s.stdin.Close()
+		s.kill()
+	}
+	return pr.runtime.Stop()
+}
+
+// stderrLogger logs whatever a persistent plugin writes to its stderr, there
+// is nobody else waiting for it.
+type stderrLogger struct {
+	name string
+}
+
+func (sl stderrLogger) Write(p []byte) (int, error) {
+	log.Errorf("Plugin (%s) threw an error: %s", sl.name, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
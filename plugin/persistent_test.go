@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoScript replies to every input with a frame containing its body, when
+// the body is "die" it exits without replying and with "hang" it never replies.
+const echoScript = `#!/bin/sh
+while read line; do
+  id=$(echo "$line" | sed 's/.*"id":"\([^"]*\)".*/\1/')
+  body=$(echo "$line" | sed 's/.*"body":"\([^"]*\)".*/\1/')
+  if [ "$body" = "die" ]; then
+    exit 1
+  fi
+  if [ "$body" = "hang" ]; then
+    sleep 60
+  fi
+  echo "{\"id\":\"$id\",\"stdout\":\"$body from $$\"}"
+done
+`
+
+func writeScript(assert *assert.Assertions, content string) string {
+	dir, err := ioutil.TempDir("", "botella")
+	assert.NoError(err)
+
+	path := filepath.Join(dir, "plugin.sh")
+	assert.NoError(ioutil.WriteFile(path, []byte(content), 0755))
+	return path
+}
+
+func newPersistentEcho(assert *assert.Assertions) *PersistentRuntime {
+	path := writeScript(assert, echoScript)
+	r, err := NewExecRuntime(ExecOptions{Command: path})
+	assert.NoError(err)
+
+	pr, err := NewPersistentRuntime(r)
+	assert.NoError(err)
+	return pr
+}
+
+func TestPersistentRuntimeKeepsTheProcessRunning(t *testing.T) {
+	assert := assert.New(t)
+
+	pr := newPersistentEcho(assert)
+	defer pr.Stop()
+
+	first, stderr, err := pr.Run(context.Background(), NewInput("", "", "ping"))
+	assert.NoError(err)
+	assert.Equal("", stderr)
+
+	second, _, err := pr.Run(context.Background(), NewInput("", "", "ping"))
+	assert.NoError(err)
+
+	// Same PID on both replies
+	assert.Contains(first, "ping from ")
+	assert.Equal(first, second)
+}
+
+func TestPersistentRuntimeRestartsTheProcess(t *testing.T) {
+	assert := assert.New(t)
+
+	minBackoff = 10 * time.Millisecond
+	defer func() { minBackoff = time.Second }()
+
+	pr := newPersistentEcho(assert)
+	defer pr.Stop()
+
+	_, _, err := pr.Run(context.Background(), NewInput("", "", "die"))
+	assert.Equal(errSessionDied, err)
+
+	// The run waits until the process is restarted
+	stdout, _, err := pr.Run(context.Background(), NewInput("", "", "ping"))
+	assert.NoError(err)
+	assert.Contains(stdout, "ping from ")
+}
+
+// plainRuntime is a runtime that can not be run persistently or on a pool.
+type plainRuntime struct{}
+
+func (plainRuntime) Run(context.Context, Input) (string, string, error) { return "", "", nil }
+func (plainRuntime) Stop() error                                        { return nil }
+
+func TestPersistentRuntimeNotSupported(t *testing.T) {
+	_, err := NewPersistentRuntime(plainRuntime{})
+	assert.Error(t, err)
+}
+
+func TestPersistentRuntimeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	minBackoff = 10 * time.Millisecond
+	defer func() { minBackoff = time.Second }()
+
+	pr := newPersistentEcho(assert)
+	defer pr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := pr.Run(ctx, NewInput("", "", "hang"))
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// The process was killed but it's back again
+	stdout, _, err := pr.Run(context.Background(), NewInput("", "", "ping"))
+	assert.NoError(err)
+	assert.Contains(stdout, "ping from ")
+}
+
+func TestPersistentRuntimeStoppedWhileWaiting(t *testing.T) {
+	assert := assert.New(t)
+
+	minBackoff = time.Minute
+	defer func() { minBackoff = time.Second }()
+
+	pr := newPersistentEcho(assert)
+	_, _, err := pr.Run(context.Background(), NewInput("", "", "die"))
+	assert.Equal(errSessionDied, err)
+
+	// The process is not going to be restarted for a while
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = pr.Run(ctx, NewInput("", "", "ping"))
+	assert.Equal(context.DeadlineExceeded, err)
+
+	errs := make(chan error)
+	go func() {
+		_, _, err := pr.Run(context.Background(), NewInput("", "", "ping"))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	pr.Stop()
+	assert.Equal(errStopped, <-errs)
+}
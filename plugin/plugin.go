@@ -1,40 +1,96 @@
 package plugin
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/fsouza/go-dockerclient"
 
 	"github.com/agonzalezro/botella/utils"
 )
 
+// Runtime is what actually runs the plugin: it writes the input JSON to the
+// plugin stdin and collects whatever the plugin wrote to stdout & stderr.
+//
+// When the context is done the runtime needs to kill the plugin.
+type Runtime interface {
+	Run(context.Context, Input) (stdout string, stderr string, err error)
+	Stop() error
+}
+
 type Plugin struct {
+	// Name identifies the plugin on the logs, it's the image for Docker
+	// plugins and the command for the exec ones, unless it's set on the
+	// config or on the labels of the image.
+	Name  string
 	Image string
+	// Description says what the plugin does and Usage how to use it, they
+	// are shown by the built-in help.
+	Description string
+	Usage       string
 
-	client    *docker.Client
-	container *docker.Container
+	runtime Runtime
 
-	environment map[string]string
+	// Timeout is the maximum time that a run can take, 0 means no timeout.
+	Timeout time.Duration
+	// TimeoutMessage is the reply sent when the plugin times out, it
+	// doesn't reply at all if it's empty.
+	TimeoutMessage string
 
 	RunOnlyOnChannels       bool
 	RunOnlyOnDirectMessages bool
 	RunOnlyOnMentions       bool
+	// RespondToBots makes the plugin run for the messages of other bots too
+	RespondToBots bool
+
+	// Triggers, if set, are checked before running the plugin
+	Triggers *Triggers
+
+	// ReplyInThread is one of ReplyInThreadAlways, ReplyInThreadIfThreaded
+	// (default) or ReplyInThreadNever.
+	ReplyInThread string
+}
+
+const (
+	// ReplyInThreadAlways replies in the thread of the message, starting
+	// one if the message wasn't in a thread.
+	ReplyInThreadAlways = "always"
+	// ReplyInThreadIfThreaded replies in the thread only if the message
+	// was in a thread.
+	ReplyInThreadIfThreaded = "if-threaded"
+	// ReplyInThreadNever always replies outside of the threads.
+	ReplyInThreadNever = "never"
+)
+
+// TimeoutError is returned when a plugin run takes longer than its timeout.
+type TimeoutError struct {
+	Plugin  string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Plugin (%s) timed out after %s", e.Plugin, e.Timeout)
 }
 
 type Input struct {
+	// ID identifies the input on the persistent plugins, the same ID needs
+	// to be present on the reply.
+	ID       string `json:"id,omitempty"`
 	Version  int    `json:"version,omitempty"`
 	Emitter  string `json:"emitter,omitempty"`
 	Receiver string `json:"receiver,omitempty"`
-	Body     string `json:"body"`
+	// Thread is the thread where the message was sent, if any
+	Thread string `json:"thread,omitempty"`
+	Body   string `json:"body"`
+	// Matches are the values captured by the trigger of the plugin
+	Matches map[string]string `json:"matches,omitempty"`
 }
 
 func NewInput(emitter, receiver, body string) Input {
 	return Input{
-		Version:  -1, // TODO: not used yet
+		Version:  ProtocolVersion,
 		Emitter:  emitter,
 		Receiver: receiver,
 		Body:     body,
@@ -50,7 +106,7 @@ func (i Input) JSON() string {
 	return string(b)
 }
 
-func environmentAsArrayOfString(image string, environment map[string]string) []string {
+func environmentAsArrayOfString(prefix string, environment map[string]string) []string {
 	var (
 		arrayOfEnvs []string
 		err         error
@@ -58,7 +114,7 @@ func environmentAsArrayOfString(image string, environment map[string]string) []s
 	for k, v := range environment {
 		// We want to override it with a value from the environment
 		if v == "" {
-			v, err = utils.GetFromEnvOrFromMap(image, nil, k)
+			v, err = utils.GetFromEnvOrFromMap(prefix, nil, k)
 			if err != nil {
 				log.Warning(err)
 			}
@@ -68,74 +124,26 @@ func environmentAsArrayOfString(image string, environment map[string]string) []s
 	return arrayOfEnvs
 }
 
-func New(image string, environment map[string]string, volumes []string) (*Plugin, error) {
-	client, err := docker.NewClientFromEnv()
-	if err != nil {
-		return nil, err
-	}
-
-	// TODO: don't always pull images, check imagePullPolicy from yaml
-	if err := client.PullImage(
-		docker.PullImageOptions{Repository: image},
-		docker.AuthConfiguration{},
-	); err != nil {
-		return nil, err
-	}
-
-	container, err := client.CreateContainer(docker.CreateContainerOptions{
-		Config: &docker.Config{
-			Image:        image,
-			Env:          environmentAsArrayOfString(image, environment),
-			AttachStdin:  true, // TODO: not sure what of these are needed
-			AttachStdout: true,
-			OpenStdin:    true,
-			StdinOnce:    true,
-		},
-		HostConfig: &docker.HostConfig{
-			Binds: volumes,
-		},
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	log.Debugf("Plugin/Container (%s) created: %+v", image, container)
-	return &Plugin{
-		Image:       image,
-		client:      client,
-		container:   container,
-		environment: environment,
-	}, nil
+// New returns a plugin called name that will be run on the given runtime.
+func New(name string, runtime Runtime) *Plugin {
+	return &Plugin{Name: name, runtime: runtime}
 }
 
 func (p *Plugin) Stop() error {
-	return p.client.RemoveContainer(
-		docker.RemoveContainerOptions{ID: p.container.ID, Force: true})
+	return p.runtime.Stop()
 }
 
 func (p *Plugin) Run(input Input) (string, string, error) {
-	// TODO: not sure if we should do this or keep an ongoing container running
-	if err := p.client.StartContainer(p.container.ID, nil); err != nil {
-		return "", "", err
+	if p.Timeout == 0 {
+		return p.runtime.Run(context.Background(), input)
 	}
 
-	var outBuf, errBuf bytes.Buffer
-	if err := p.client.AttachToContainer(docker.AttachToContainerOptions{
-		Container:    p.container.ID,
-		Stdin:        true,
-		Stdout:       true,
-		Stderr:       true,
-		InputStream:  strings.NewReader(input.JSON()),
-		OutputStream: &outBuf,
-		ErrorStream:  &errBuf,
-		Stream:       true,
-	}); err != nil {
-		return "", "", err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
 
-	if _, err := p.client.WaitContainer(p.container.ID); err != nil {
-		return "", "", err
+	stdout, stderr, err := p.runtime.Run(ctx, input)
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", "", &TimeoutError{Plugin: p.Name, Timeout: p.Timeout}
 	}
-
-	return outBuf.String(), errBuf.String(), nil
+	return stdout, stderr, err
 }
@@ -3,6 +3,7 @@ package plugin
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,3 +36,22 @@ func TestEnvironmentValuesFromEnvironmentVariables(t *testing.T) {
 	assert.Equal(1, len(output))
 	assert.Equal("secret=value", output[0])
 }
+
+func TestPluginTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := NewExecRuntime(ExecOptions{Command: "sleep 5"})
+	assert.NoError(err)
+
+	p := New("sleep", r)
+	p.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, _, err = p.Run(NewInput("", "", ""))
+	assert.True(time.Since(start) < time.Second, "the process wasn't killed")
+
+	timeoutErr, ok := err.(*TimeoutError)
+	assert.True(ok, "%v is not a TimeoutError", err)
+	assert.Equal("sleep", timeoutErr.Plugin)
+	assert.Equal(p.Timeout, timeoutErr.Timeout)
+}
@@ -0,0 +1,186 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// cloner is implemented by the runtimes that can create new instances of
+// themselves, for example, one more container of the same image.
+type cloner interface {
+	clone() (Runtime, error)
+}
+
+type PoolOptions struct {
+	// MaxConcurrency is the maximum number of runs at the same time, the
+	// rest will be queued until one of the runtimes is free.
+	MaxConcurrency int
+	// MinIdle is the number of runtimes that are kept created and waiting
+	// for new runs.
+	MinIdle int
+}
+
+// PoolRuntime dispatches every run to a free runtime of the pool, creating
+// new ones (up to MaxConcurrency) when all of them are busy.
+type PoolRuntime struct {
+	template cloner
+	options  PoolOptions
+
+	// slots limits the concurrent runs, a run waits here until there is one
+	slots chan struct{}
+
+	mu sync.Mutex
+	// available is signaled every time a runtime is added to idle
+	available *sync.Cond
+	idle      []Runtime
+	all       []Runtime
+	// size is the number of runtimes created or being created
+	size int
+}
+
+// NewPoolRuntime returns a pool with the given runtime on it, the rest of
+// the runtimes of the pool will be cloned from it.
+func NewPoolRuntime(runtime Runtime, options PoolOptions) (*PoolRuntime, error) {
+	template, ok := runtime.(cloner)
+	if !ok {
+		return nil, fmt.Errorf("runtime %T can't be run on a pool", runtime)
+	}
+	if options.MaxConcurrency < 1 {
+		options.MaxConcurrency = 1
+	}
+	if options.MinIdle > options.MaxConcurrency {
+		options.MinIdle = options.MaxConcurrency
+	}
+
+	pr := &PoolRuntime{
+		template: template,
+		options:  options,
+		slots:    make(chan struct{}, options.MaxConcurrency),
+		idle:     []Runtime{runtime},
+		all:      []Runtime{runtime},
+		size:     1,
+	}
+	pr.available = sync.NewCond(&pr.mu)
+	for pr.reserve(true) {
+		if err := pr.create(); err != nil {
+			pr.Stop()
+			return nil, err
+		}
+	}
+	return pr, nil
+}
+
+// reserve makes room for a new runtime on the pool if there is space for it,
+// when onlyIfNeeded is set there is only room if we are below MinIdle.
+func (pr *PoolRuntime) reserve(onlyIfNeeded bool) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.reserveLocked(onlyIfNeeded)
+}
+
+func (pr *PoolRuntime) reserveLocked(onlyIfNeeded bool) bool {
+	if pr.size >= pr.options.MaxConcurrency {
+		return false
+	}
+	// Runtimes reserved but still being created will be idle soon
+	if onlyIfNeeded && len(pr.idle)+pr.size-len(pr.all) >= pr.options.MinIdle {
+		return false
+	}
+	pr.size++
+	return true
+}
+
+// create adds a new idle runtime to the pool, reserve must be called first.
+func (pr *PoolRuntime) create() error {
+	r, err := pr.template.clone()
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if err != nil {
+		pr.size--
+		// Somebody could be waiting for this one to be created
+		pr.available.Broadcast()
+		return err
+	}
+	pr.all = append(pr.all, r)
+	pr.put(r)
+	return nil
+}
+
+// get returns a free runtime, a slot must be taken before.
+func (pr *PoolRuntime) get() (Runtime, error) {
+	pr.mu.Lock()
+	for len(pr.idle) == 0 {
+		if pr.reserveLocked(false) {
+			pr.mu.Unlock()
+			if err := pr.create(); err != nil {
+				return nil, err
+			}
+			pr.mu.Lock()
+			continue
+		}
+		// All of them are busy or being created
+		pr.available.Wait()
+	}
+
+	n := len(pr.idle)
+	r := pr.idle[n-1]
+	pr.idle = pr.idle[:n-1]
+	pr.mu.Unlock()
+	return r, nil
+}
+
+// put returns the runtime to the pool, the lock must be held.
+func (pr *PoolRuntime) put(r Runtime) {
+	pr.idle = append(pr.idle, r)
+	pr.available.Signal()
+}
+
+// fill creates in background the idle runtimes needed to reach MinIdle.
+func (pr *PoolRuntime) fill() {
+	for pr.reserve(true) {
+		if err := pr.create(); err != nil {
+			log.Errorf("Error creating a new runtime for the pool: %v", err)
+			return
+		}
+	}
+}
+
+func (pr *PoolRuntime) Run(ctx context.Context, input Input) (string, string, error) {
+	// The time waiting on the queue counts for the timeout
+	select {
+	case pr.slots <- struct{}{}:
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+	defer func() { <-pr.slots }()
+
+	r, err := pr.get()
+	if err != nil {
+		return "", "", err
+	}
+	go pr.fill()
+	defer func() {
+		pr.mu.Lock()
+		pr.put(r)
+		pr.mu.Unlock()
+	}()
+
+	return r.Run(ctx, input)
+}
+
+func (pr *PoolRuntime) Stop() error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	var lastErr error
+	for _, r := range pr.all {
+		if err := r.Stop(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowRuntime takes some time on every run and counts how many runs are
+// happening at the same time.
+type slowRuntime struct {
+	running, maxRunning, clones *int32
+}
+
+func newSlowRuntime() *slowRuntime {
+	return &slowRuntime{new(int32), new(int32), new(int32)}
+}
+
+func (sr *slowRuntime) Run(context.Context, Input) (string, string, error) {
+	n := atomic.AddInt32(sr.running, 1)
+	defer atomic.AddInt32(sr.running, -1)
+	for {
+		max := atomic.LoadInt32(sr.maxRunning)
+		if n <= max || atomic.CompareAndSwapInt32(sr.maxRunning, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return "done", "", nil
+}
+
+func (sr *slowRuntime) Stop() error { return nil }
+
+func (sr *slowRuntime) clone() (Runtime, error) {
+	atomic.AddInt32(sr.clones, 1)
+	return &slowRuntime{sr.running, sr.maxRunning, sr.clones}, nil
+}
+
+func TestPoolRuntimeLimitsTheConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newSlowRuntime()
+	pr, err := NewPoolRuntime(r, PoolOptions{MaxConcurrency: 3})
+	assert.NoError(err)
+	defer pr.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stdout, _, err := pr.Run(context.Background(), NewInput("", "", ""))
+			assert.NoError(err)
+			assert.Equal("done", stdout)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int32(3), atomic.LoadInt32(r.maxRunning))
+	assert.Equal(3, len(pr.all))
+	assert.Equal(3, len(pr.idle))
+}
+
+func TestPoolRuntimeCreatesTheMinIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newSlowRuntime()
+	pr, err := NewPoolRuntime(r, PoolOptions{MaxConcurrency: 5, MinIdle: 2})
+	assert.NoError(err)
+	defer pr.Stop()
+
+	assert.Equal(int32(1), atomic.LoadInt32(r.clones))
+	assert.Equal(2, len(pr.idle))
+}
+
+func TestPoolRuntimeNotSupported(t *testing.T) {
+	_, err := NewPoolRuntime(plainRuntime{}, PoolOptions{})
+	assert.Error(t, err)
+}
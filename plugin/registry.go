@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+
+	"github.com/agonzalezro/botella/utils"
+)
+
+// dockerHubRegistry is how the Docker Hub is identified on ~/.docker/config.json
+const dockerHubRegistry = "https://index.docker.io/v1/"
+
+// registryOf returns the registry where the image lives, the first part of
+// the image name is the registry if it looks like a host.
+func registryOf(image string) string {
+	fragments := strings.SplitN(image, "/", 2)
+	if len(fragments) < 2 {
+		return dockerHubRegistry
+	}
+	host := fragments[0]
+	if host == "localhost" || strings.ContainsAny(host, ".:") {
+		return host
+	}
+	return dockerHubRegistry
+}
+
+// repositoryOf returns the image name without its tag or digest.
+func repositoryOf(image string) string {
+	repository := strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return repository
+}
+
+// digestOf returns the digest that the image is pinned to, for example,
+// sha256:xxx for image@sha256:xxx. It's empty if the image is not pinned.
+func digestOf(image string) string {
+	fragments := strings.SplitN(image, "@", 2)
+	if len(fragments) < 2 {
+		return ""
+	}
+	return fragments[1]
+}
+
+// hasDigest checks if any of the repo digests of an image is the given one.
+func hasDigest(repoDigests []string, digest string) bool {
+	for _, repoDigest := range repoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// registryAuth returns the credentials needed to pull the image. They are read
+// from the environment or the auth map (keys: username, password, email &
+// server_address) and if they are not there from the Docker config file.
+func registryAuth(image string, auth map[string]string, dockerCfg *docker.AuthConfigurations) docker.AuthConfiguration {
+	prefix := repositoryOf(image) + "/registry"
+	get := func(k string) string {
+		v, _ := utils.GetFromEnvOrFromMap(prefix, auth, k)
+		return v
+	}
+
+	registry := registryOf(image)
+	if username := get("username"); username != "" {
+		serverAddress := get("server_address")
+		if serverAddress == "" {
+			serverAddress = registry
+		}
+		return docker.AuthConfiguration{
+			Username:      username,
+			Password:      get("password"),
+			Email:         get("email"),
+			ServerAddress: serverAddress,
+		}
+	}
+
+	if dockerCfg == nil {
+		return docker.AuthConfiguration{}
+	}
+	for _, address := range []string{registry, "https://" + registry, "http://" + registry} {
+		if c, ok := dockerCfg.Configs[address]; ok {
+			log.Debugf("Using the credentials of %s from the Docker config for %s", address, image)
+			return c
+		}
+	}
+	return docker.AuthConfiguration{}
+}
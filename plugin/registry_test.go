@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryOf(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := map[string]string{
+		"busybox":                             dockerHubRegistry,
+		"agonzalezro/botella-test":            dockerHubRegistry,
+		"registry.example.com/team/plugin":    "registry.example.com",
+		"localhost:5000/plugin:latest":        "localhost:5000",
+		"localhost/plugin":                    "localhost",
+		"quay.io/team/plugin@sha256:abcdef01": "quay.io",
+	}
+	for in, expected := range cases {
+		assert.Equal(expected, registryOf(in), in)
+	}
+}
+
+func TestRepositoryOf(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("busybox", repositoryOf("busybox"))
+	assert.Equal("busybox", repositoryOf("busybox:latest"))
+	assert.Equal("localhost:5000/plugin", repositoryOf("localhost:5000/plugin:1.0"))
+	assert.Equal("localhost:5000/plugin", repositoryOf("localhost:5000/plugin@sha256:abc"))
+}
+
+func TestDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", digestOf("busybox:latest"))
+	assert.Equal("sha256:abc", digestOf("busybox@sha256:abc"))
+
+	repoDigests := []string{"busybox@sha256:abc", "docker.io/library/busybox@sha256:def"}
+	assert.True(hasDigest(repoDigests, "sha256:abc"))
+	assert.True(hasDigest(repoDigests, "sha256:def"))
+	assert.False(hasDigest(repoDigests, "sha256:ab"))
+}
+
+func TestRegistryAuthFromTheConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	auth := registryAuth("registry.example.com/plugin", map[string]string{
+		"username": "user",
+		"password": "pass",
+	}, nil)
+	assert.Equal("user", auth.Username)
+	assert.Equal("pass", auth.Password)
+	assert.Equal("registry.example.com", auth.ServerAddress)
+}
+
+func TestRegistryAuthFromTheEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(os.Setenv("REGISTRY_EXAMPLE_COM_ENV_REGISTRY_PASSWORD", "from-env"))
+	defer os.Unsetenv("REGISTRY_EXAMPLE_COM_ENV_REGISTRY_PASSWORD")
+
+	auth := registryAuth("registry.example.com/env:latest", map[string]string{
+		"username": "user",
+		"password": "",
+	}, nil)
+	assert.Equal("user", auth.Username)
+	assert.Equal("from-env", auth.Password)
+}
+
+func TestRegistryAuthFromTheDockerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dockerCfg := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		dockerHubRegistry:              {Username: "hub"},
+		"https://registry.example.com": {Username: "private"},
+	}}
+
+	assert.Equal("hub", registryAuth("agonzalezro/botella-test", nil, dockerCfg).Username)
+	assert.Equal("private", registryAuth("registry.example.com/plugin", nil, dockerCfg).Username)
+	assert.Equal("", registryAuth("quay.io/plugin", nil, dockerCfg).Username)
+	assert.Equal("", registryAuth("quay.io/plugin", nil, nil).Username)
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Triggers decide if a plugin needs to be run for a message, without
+// starting it. A message triggers the plugin if it's one of the commands
+// (with the prefix before it) or if it matches any of the regexes.
+//
+// The mentions at the beginning of the message are ignored, so
+// "@botella !deploy" is the command "deploy" with the prefix "!".
+type Triggers struct {
+	Prefix   string
+	Commands []string
+	Regexes  []*regexp.Regexp
+}
+
+func NewTriggers(prefix string, commands []string, regexes []string) (*Triggers, error) {
+	t := &Triggers{Prefix: prefix, Commands: commands}
+	for _, r := range regexes {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, err
+		}
+		t.Regexes = append(t.Regexes, re)
+	}
+	return t, nil
+}
+
+// stripMentions removes the mentions at the beginning of the body, like
+// <@U1PQFQ2SJ> on Slack or @botella on others.
+func stripMentions(body string) string {
+	body = strings.TrimSpace(body)
+	for strings.HasPrefix(body, "@") || strings.HasPrefix(body, "<@") {
+		fields := strings.SplitN(body, " ", 2)
+		if len(fields) < 2 {
+			return ""
+		}
+		body = strings.TrimSpace(fields[1])
+	}
+	return body
+}
+
+// Match checks if the body triggers the plugin, if it does it also returns
+// what was captured: the command & its args for the commands and the named
+// groups for the regexes.
+//
+// Plugins without triggers are triggered by every message.
+func (t *Triggers) Match(body string) (map[string]string, bool) {
+	if t == nil || (t.Prefix == "" && len(t.Commands) == 0 && len(t.Regexes) == 0) {
+		return nil, true
+	}
+
+	body = stripMentions(body)
+	if t.Prefix != "" && len(t.Commands) == 0 && strings.HasPrefix(body, t.Prefix) {
+		return nil, true
+	}
+
+	if strings.HasPrefix(body, t.Prefix) {
+		fields := strings.SplitN(strings.TrimPrefix(body, t.Prefix), " ", 2)
+		for _, command := range t.Commands {
+			if strings.EqualFold(fields[0], command) {
+				matches := map[string]string{"command": command, "args": ""}
+				if len(fields) > 1 {
+					matches["args"] = strings.TrimSpace(fields[1])
+				}
+				return matches, true
+			}
+		}
+	}
+
+	for _, re := range t.Regexes {
+		submatches := re.FindStringSubmatch(body)
+		if submatches == nil {
+			continue
+		}
+		matches := make(map[string]string)
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				matches[name] = submatches[i]
+			}
+		}
+		return matches, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoTriggersMatchEverything(t *testing.T) {
+	assert := assert.New(t)
+
+	var nilTriggers *Triggers
+	_, ok := nilTriggers.Match("whatever")
+	assert.True(ok)
+
+	_, ok = (&Triggers{}).Match("whatever")
+	assert.True(ok)
+}
+
+func TestCommandTriggers(t *testing.T) {
+	assert := assert.New(t)
+
+	triggers, err := NewTriggers("!", []string{"deploy", "ping"}, nil)
+	assert.NoError(err)
+
+	cases := map[string]map[string]string{
+		"!deploy production":             {"command": "deploy", "args": "production"},
+		"!PING":                          {"command": "ping", "args": ""},
+		"<@U1PQFQ2SJ> !ping":             {"command": "ping", "args": ""},
+		"@botella !deploy  staging now ": {"command": "deploy", "args": "staging now"},
+	}
+	for body, expected := range cases {
+		matches, ok := triggers.Match(body)
+		assert.True(ok, body)
+		assert.Equal(expected, matches, body)
+	}
+
+	for _, body := range []string{"deploy", "!deployment", "please !deploy", "<@U1PQFQ2SJ>", ""} {
+		_, ok := triggers.Match(body)
+		assert.False(ok, body)
+	}
+}
+
+func TestPrefixOnlyTriggers(t *testing.T) {
+	assert := assert.New(t)
+
+	triggers, err := NewTriggers("!", nil, nil)
+	assert.NoError(err)
+
+	_, ok := triggers.Match("!anything")
+	assert.True(ok)
+	_, ok = triggers.Match("anything")
+	assert.False(ok)
+}
+
+func TestRegexTriggers(t *testing.T) {
+	assert := assert.New(t)
+
+	triggers, err := NewTriggers("", nil, []string{
+		`^deploy (?P<app>\w+) to (?P<env>\w+)$`,
+		`(?i)pong`,
+	})
+	assert.NoError(err)
+
+	matches, ok := triggers.Match("<@U1PQFQ2SJ> deploy botella to production")
+	assert.True(ok)
+	assert.Equal(map[string]string{"app": "botella", "env": "production"}, matches)
+
+	matches, ok = triggers.Match("PONG!")
+	assert.True(ok)
+	assert.Empty(matches)
+
+	_, ok = triggers.Match("deploy botella")
+	assert.False(ok)
+
+	_, err = NewTriggers("", nil, []string{"("})
+	assert.Error(err)
+}
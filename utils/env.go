@@ -7,7 +7,7 @@ import (
 )
 
 func sanitizePrefix(prefix string) string {
-	replacements := []string{"/", "-"}
+	replacements := []string{"/", "-", ".", ":", "@"}
 
 	for _, replacement := range replacements {
 		prefix = strings.Replace(prefix, replacement, "_", -1)
@@ -21,7 +21,7 @@ func sanitizePrefix(prefix string) string {
 // If the environment variable is set, it has preference. The environment var
 // will be queried all uppercased.
 //
-// Note: the / char in the prefix will be transformed to _
+// Note: the /, -, ., : and @ chars in the prefix will be transformed to _
 func GetFromEnvOrFromMap(prefix string, kvs map[string]string, k string) (string, error) {
 	envVar := strings.ToUpper(fmt.Sprintf("%s_%s", sanitizePrefix(prefix), k))
 	v := os.Getenv(envVar)
@@ -32,3 +32,14 @@ func TestNotFound(t *testing.T) {
 	_, err := GetFromEnvOrFromMap("", nil, "not-found")
 	assert.Error(t, err)
 }
+
+func TestAValueFromAnEnvVarWithARegistryPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	err := os.Setenv("REGISTRY_EXAMPLE_COM_5000_A_REGISTRY_USERNAME", "value")
+	assert.NoError(err)
+
+	v, err := GetFromEnvOrFromMap("registry.example.com:5000/a/registry", nil, "username")
+	assert.NoError(err)
+	assert.Equal("value", v)
+}